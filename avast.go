@@ -10,24 +10,39 @@ Avast - Golang Avast client
 package avast
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"net/textproto"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 )
 
 const (
-	unixSockErr    = "The unix socket: %s does not exist"
-	invalidRespErr = "Invalid server response: %s"
-	excludeOKResp  = "200 EXCLUDE OK"
-	scanOkResp     = "200 SCAN OK"
-	urlBlockedResp = "URL blocked"
+	unixSockErr       = "The unix socket: %s does not exist"
+	unsupportedNetErr = "Unsupported network: %s"
+	invalidRespErr    = "Invalid server response: %q"
+	invalidOptionErr  = "Invalid option: %d"
+	excludePathErr    = "The exclude path must be absolute: %q"
+	tlsUnixErr        = "TLS is not supported over unix sockets"
+	excludeOKResp     = "200 EXCLUDE OK"
+	scanOkResp        = "200 SCAN OK"
+	urlBlockedResp    = "URL blocked"
+	archiveSep        = "|>"
+	unknownCmdCode    = 500
+	noSuchPathCode    = 550
 	// DefaultTimeout is the default connection timeout
 	DefaultTimeout = 15 * time.Second
 	// DefaultCmdTimeout is the default IO timeout
@@ -152,8 +167,10 @@ const (
 
 var (
 	// ZeroTime holds the zero value of time
-	ZeroTime   time.Time
-	responseRe = regexp.MustCompile(`^SCAN (?P<filename>[^\t]+)\t(?:\[(?P<status>[+LE])\])(?P<depth>\d\.\d)(?:\t(?P<signature>.+))?$`)
+	ZeroTime     time.Time
+	aLongTimeAgo = time.Unix(1, 0)
+	vpsDateFmts  = []string{"2006-01-02", "2006/01/02", "20060102", time.RFC3339}
+	responseRe   = regexp.MustCompile(`^SCAN (?P<filename>[^\t]+)\t(?:\[(?P<status>[+LE])\])(?P<depth>\d\.\d)(?:\t(?P<signature>.+))?$`)
 )
 
 // SensiOption represents Avast Sensitivity options
@@ -316,37 +333,210 @@ func (c Command) Len() (l int) {
 	return
 }
 
-// Response represents the response from the server
+// Response represents the response from the server.
+// Errored is set when the server could not scan the item,
+// the reason is then held in Signature.
+// The SCAN protocol does not report the offset of a
+// detection within a file so none is available here.
+// ArchiveItem holds the member chain as sent by the server,
+// each member prefixed with > and separated by |, so an item
+// nested in b.tar within a.zip is ">b.tar|>c.com". The split
+// names are held in ArchivePath.
 type Response struct {
+	Command     Command
 	Filename    string
+	RawFilename string
 	ArchiveItem string
+	Depth       float64
 	Signature   string
 	Status      string
+	ScanStatus  ScanStatus
 	Infected    bool
+	Errored     bool
 	Raw         string
+	Path        string
+	ArchivePath []string
 }
 
-// A Client represents an Avast client.
+// Framing holds the opening and closing lines of a response
+type Framing struct {
+	Open  string
+	Close string
+}
+
+// A Client represents an Avast client. It is safe for
+// concurrent use, the setters included, each command holds the
+// connection until its response has been read so commands run
+// one at a time and a setter takes effect from the next command.
 type Client struct {
-	address     string
-	connTimeout time.Duration
-	connRetries int
-	connSleep   time.Duration
-	cmdTimeout  time.Duration
-	tc          *textproto.Conn
-	m           sync.Mutex
-	conn        net.Conn
+	name              string
+	network           string
+	address           string
+	connTimeout       time.Duration
+	connRetries       int
+	connSleep         time.Duration
+	cmdTimeout        time.Duration
+	bufSize           int
+	roots             []string
+	limiter           *ScanLimiter
+	parseRetries      int
+	absPaths          bool
+	captureFraming    bool
+	framing           Framing
+	lastCode          int
+	lastStatus        string
+	cmdStart          time.Time
+	lastDuration      time.Duration
+	infectedStatuses  []ScanStatus
+	syslog            io.Writer
+	syslogSDID        string
+	connectAttempts   int
+	backoffBase       time.Duration
+	backoffMax        time.Duration
+	maxIdle           time.Duration
+	lastUsed          time.Time
+	transcriptMax     int
+	transcriptSize    int
+	transcript        []string
+	resultHook        func(*Response)
+	greetingValidator func(banner string) error
+	drainGrace        time.Duration
+	broken            bool
+	autoReconnect     bool
+	logger            Logger
+	greeting          string
+	tracer            TraceFunc
+	metrics           Metrics
+	tlsConfig         *tls.Config
+	closed            bool
+	cmdRetries        int
+	dialer            DialFunc
+	maxResults        int
+	cmdID             uint
+	tmpDir            string
+	scanRoot          string
+	classifier        ThreatClassifier
+	tc                *textproto.Conn
+	m                 sync.Mutex
+	conn              net.Conn
+}
+
+// Name returns the client name
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Greeting returns the text of the server greeting read
+// when the connection was last established
+func (c *Client) Greeting() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.greeting
+}
+
+// Broken reports whether the connection was left in an
+// unknown state by a cancelled command and should not be
+// reused without reconnecting
+func (c *Client) Broken() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.broken
+}
+
+// LastFraming returns the opening and closing lines of the
+// last command response, they are only recorded when the
+// client is created with WithCaptureFraming
+func (c *Client) LastFraming() Framing {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.framing
+}
+
+// LastStatus returns the code and message of the closing
+// line of the last command, such as the detail the daemon
+// appends to "200 SCAN OK". The code is zero when the last
+// command did not complete.
+func (c *Client) LastStatus() (code int, msg string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	code, msg = c.lastCode, c.lastStatus
+	return
+}
+
+// LastCommandDuration returns the time from sending the last
+// command to reading its closing line, it is zero when the
+// last command did not complete
+func (c *Client) LastCommandDuration() time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.lastDuration
+}
+
+// LastTranscript returns the lines sent and received by the
+// last command, sent lines are prefixed with "> " and received
+// lines with "< ". It is only recorded when the client is
+// created with WithTranscript.
+func (c *Client) LastTranscript() []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.lastTranscript()
+}
+
+// ConnTimeout returns the connection timeout
+func (c *Client) ConnTimeout() time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.connTimeout
+}
+
+// CmdTimeout returns the cmd timeout
+func (c *Client) CmdTimeout() time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.cmdTimeout
+}
+
+// ConnRetries returns the number of times
+// connection is retried
+func (c *Client) ConnRetries() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.connRetries
+}
+
+// ConnSleep returns the connection retry sleep duration
+func (c *Client) ConnSleep() time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.connSleep
 }
 
 // SetConnTimeout sets the connection timeout
 func (c *Client) SetConnTimeout(t time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
 	if t > 0 {
 		c.connTimeout = t
 	}
 }
 
-// SetCmdTimeout sets the cmd timeout
+// SetCmdTimeout sets the cmd timeout, the daemon scan timeout
+// can not be queried so set this above the daemon configuration
 func (c *Client) SetCmdTimeout(t time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
 	if t > 0 {
 		c.cmdTimeout = t
 	}
@@ -355,323 +545,1787 @@ func (c *Client) SetCmdTimeout(t time.Duration) {
 // SetConnRetries sets the number of times
 // connection is retried
 func (c *Client) SetConnRetries(s int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
 	if s < 0 {
 		s = 0
 	}
 	c.connRetries = s
 }
 
+// SetAutoReconnect sets whether a command that fails because
+// the connection was closed is replayed once on a new connection.
+// When disabled a connection left broken by a cancelled command
+// is not reused, later commands fail with ErrBrokenConnection.
+func (c *Client) SetAutoReconnect(v bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.autoReconnect = v
+}
+
+// A DialFunc establishes the connection to the server
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// A TraceFunc is called when a command starts with the command
+// and its argument, the returned context is used for the command
+// and end is called when it completes with the number of scan
+// results and the error if any
+type TraceFunc func(ctx context.Context, cmd Command, arg string) (context.Context, func(results int, err error))
+
+// SetTracer sets the function used to trace commands,
+// nil disables tracing
+func (c *Client) SetTracer(f TraceFunc) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.tracer = f
+}
+
+// Metrics receives command, scan result and reconnect events,
+// it lets the client be adapted to a metrics library
+type Metrics interface {
+	OnCommand(cmd Command, dur time.Duration, err error)
+	OnScanResult(r *Response)
+	OnReconnect(err error)
+}
+
+// SetMetrics sets the metrics receiver, nil disables metrics
+func (c *Client) SetMetrics(m Metrics) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.metrics = m
+}
+
+// SetLogger sets a function called with every protocol line
+// sent and received, nil disables logging
+func (c *Client) SetLogger(l Logger) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.logger = l
+}
+
+// CmdRetries returns the number of times a command
+// that fails with a transient error is retried
+func (c *Client) CmdRetries() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.cmdRetries
+}
+
+// SetCmdRetries sets the number of times a command that fails
+// with a transient error is retried, the connection retry sleep
+// is used between attempts
+func (c *Client) SetCmdRetries(n int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+	c.cmdRetries = n
+}
+
+// SetMaxResults sets the maximum number of result lines read
+// for a scan, the scan fails with ErrTooManyResults once it is
+// exceeded and the connection is marked broken. Zero removes
+// the limit, which is the default.
+func (c *Client) SetMaxResults(n int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+	c.maxResults = n
+}
+
 // SetConnSleep sets the connection retry sleep
 // duration in seconds
 func (c *Client) SetConnSleep(s time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
 	if s > 0 {
 		c.connSleep = s
 	}
 }
 
-// Scan submits a path for scanning
-func (c *Client) Scan(p string) (r []*Response, err error) {
-	r, err = c.fileCmd(p)
-	return
-}
+// SetMaxIdle sets how long the connection may be idle before
+// it is dialed again ahead of the next command, so that a
+// connection dropped by the server while idle is not found
+// dead mid command. It needs auto reconnect, zero disables it
+// which is the default.
+func (c *Client) SetMaxIdle(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if d < 0 {
+		d = 0
+	}
+	c.maxIdle = d
+}
+
+// backoff returns the sleep before retry attempt i, counting
+// from zero. It is the connection retry sleep unless a backoff
+// is set with WithConnectBackoff, the delay then doubles from
+// the base up to the max and is drawn from the upper half of
+// that so clients restarting together spread their retries.
+func (c *Client) backoff(i int) time.Duration {
+	if c.backoffBase <= 0 {
+		return c.connSleep
+	}
+
+	d := c.backoffBase
+	for ; i > 0 && d < c.backoffMax; i-- {
+		d *= 2
+	}
+	if d > c.backoffMax {
+		d = c.backoffMax
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// SetScanRoot sets the directory, as the server sees it, that
+// relative scan paths are joined to before they are sent,
+// absolute paths are sent unchanged. Content spooled by
+// ScanReader is written to the temporary directory by this
+// process and is not joined to the scan root, the temporary
+// directory must be at the same path for the server.
+func (c *Client) SetScanRoot(base string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.scanRoot = base
+}
+
+// scanPath joins a relative path p to the scan root if set
+func (c *Client) scanPath(p string) string {
+	c.m.Lock()
+	root := c.scanRoot
+	c.m.Unlock()
+
+	if root == "" || p == "" || filepath.IsAbs(p) {
+		return p
+	}
+
+	return filepath.Join(root, p)
+}
+
+// Scan submits a path for scanning
+func (c *Client) Scan(p string) (r []*Response, err error) {
+	r, err = c.ScanContext(context.Background(), p)
+	return
+}
+
+// ScanContext submits a path for scanning, the scan is aborted
+// when ctx is done. The rest of an aborted response is drained
+// when the client is created with WithCancelDrain, Broken
+// reports whether the connection is still usable afterwards.
+func (c *Client) ScanContext(ctx context.Context, p string) (r []*Response, err error) {
+	p = c.scanPath(p)
+	if err = c.checkPath(p); err != nil {
+		return
+	}
+
+	r, err = c.scan(ctx, p)
+
+	return
+}
+
+// ScanStream submits a path for scanning and sends each result
+// on the returned channel as it is read, the results channel is
+// closed once the response ends and the error channel then
+// delivers the error if any. The command is not replayed on a
+// new connection as results may already have been sent. The
+// connection is held until the response ends so other commands
+// on the client wait for the results to be consumed.
+func (c *Client) ScanStream(ctx context.Context, p string) (<-chan *Response, <-chan error) {
+	rc := make(chan *Response)
+	ec := make(chan error, 1)
+
+	go func() {
+		defer close(ec)
+
+		err := c.scanStream(ctx, p, rc)
+		close(rc)
+		if err != nil {
+			ec <- err
+		}
+	}()
+
+	return rc, ec
+}
+
+func (c *Client) scanStream(ctx context.Context, p string, rc chan<- *Response) (err error) {
+	var release func()
+
+	p = c.scanPath(p)
+	if err = c.checkPath(p); err != nil {
+		return
+	}
+
+	if release, err = c.acquireScan(ctx); err != nil {
+		return
+	}
+	defer release()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.tc == nil && (c.closed || !c.autoReconnect) {
+		err = net.ErrClosed
+		return
+	}
+
+	if c.broken && !c.autoReconnect {
+		err = ErrBrokenConnection
+		return
+	}
+
+	if c.autoReconnect && (c.broken || c.tc == nil || c.idleExpired()) {
+		if err = c.reconnect(ctx); err != nil {
+			return
+		}
+	}
+
+	n := 0
+	if c.tracer != nil {
+		var end func(int, error)
+		ctx, end = c.tracer(ctx, Scan, p)
+		defer func() { end(n, err) }()
+	}
+
+	if c.metrics != nil {
+		start := time.Now()
+		defer func() { c.metrics.OnCommand(Scan, time.Since(start), err) }()
+	}
+
+	_, err = c.doFileCmd(ctx, p, func(rs *Response) {
+		n++
+		r := []*Response{rs}
+		if c.absPaths && c.network == "unix" {
+			absFilenames(p, r)
+		}
+		rs.Path = p
+		if c.syslog != nil {
+			c.logResults(r)
+		}
+		select {
+		case rc <- rs:
+		case <-ctx.Done():
+		}
+	})
+
+	return
+}
+
+// ScanPaths scans each of paths in order over the client
+// connection, duplicate paths are scanned once. Path on each
+// response holds the path that produced it, errors for
+// individual paths are joined in err.
+func (c *Client) ScanPaths(ctx context.Context, paths []string) (r []*Response, err error) {
+	var errs []error
+
+	seen := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+
+		rs, e := c.ScanContext(ctx, p)
+		if e != nil {
+			errs = append(errs, e)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		r = append(r, rs...)
+	}
+
+	err = errors.Join(errs...)
+
+	return
+}
+
+// ScanAndAct scans p and calls onInfected for each infected
+// file once the scan is done so the callback does not hold the
+// connection. Infected archive members carry the outer file in
+// Filename and the callback is called once per file, so an
+// archive is acted on as a whole. Callback errors do not stop
+// the remaining files and are joined in err.
+func (c *Client) ScanAndAct(ctx context.Context, p string, onInfected func(*Response) error) (r []*Response, err error) {
+	var errs []error
+
+	if r, err = c.ScanContext(ctx, p); err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, rs := range r {
+		if !rs.Infected || seen[rs.Filename] {
+			continue
+		}
+		seen[rs.Filename] = true
+
+		if e := onInfected(rs); e != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rs.Filename, e))
+		}
+	}
+
+	err = errors.Join(errs...)
+
+	return
+}
+
+// acquireScan waits for a scan slot when concurrent scans are
+// limited, release must be called when the scan is done
+func (c *Client) acquireScan(ctx context.Context) (release func(), err error) {
+	if c.limiter == nil {
+		release = func() {}
+		return
+	}
+
+	release, err = c.limiter.acquire(ctx)
+
+	return
+}
+
+// scan submits a path for scanning without checking
+// it against the allowed roots
+func (c *Client) scan(ctx context.Context, p string) (r []*Response, err error) {
+	var release func()
+
+	if release, err = c.acquireScan(ctx); err != nil {
+		return
+	}
+	defer release()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	r, err = c.scanLocked(ctx, p)
+
+	return
+}
+
+// scanLocked submits a path for scanning retrying malformed
+// responses on a new connection, c.m must be held
+func (c *Client) scanLocked(ctx context.Context, p string) (r []*Response, err error) {
+	for i := 0; ; i++ {
+		var re *ResponseError
+
+		r, err = c.fileCmdLocked(ctx, p)
+		if err == nil || i >= c.parseRetries || !errors.As(err, &re) || re.Code != 0 {
+			break
+		}
+
+		if err = c.reconnect(ctx); err != nil {
+			return
+		}
+	}
+
+	if err == nil && c.absPaths && c.network == "unix" {
+		absFilenames(p, r)
+	}
+
+	for _, rs := range r {
+		rs.Path = p
+	}
+
+	if c.syslog != nil {
+		c.logResults(r)
+	}
+
+	return
+}
+
+// ScanFile submits a single file for scanning, ErrNoResult is
+// returned when the server skips the file without a verdict
+func (c *Client) ScanFile(p string) (r []*Response, err error) {
+	if r, err = c.Scan(p); err != nil {
+		return
+	}
+
+	fp := c.resultPath(p)
+	for _, rs := range r {
+		if filepath.Clean(rs.Filename) == fp {
+			return
+		}
+	}
+
+	err = fmt.Errorf("%w: %s", ErrNoResult, p)
+
+	return
+}
+
+// resultPath returns the cleaned path that results for the
+// scan of p carry, relative paths are made absolute as the
+// results are when absolute paths are enabled
+func (c *Client) resultPath(p string) (fp string) {
+	fp = filepath.Clean(c.scanPath(p))
+	if c.absPaths && c.network == "unix" {
+		if ap, err := filepath.Abs(fp); err == nil {
+			fp = ap
+		}
+	}
+
+	return
+}
+
+// Vps returns the virus definitions (VPS) version
+func (c *Client) Vps() (v int, err error) {
+	v, err = c.VpsContext(context.Background())
+	return
+}
+
+// VpsContext returns the virus definitions (VPS) version,
+// it is aborted when ctx is done
+func (c *Client) VpsContext(ctx context.Context) (v int, err error) {
+	var s string
+
+	if s, err = c.basicCmdContext(ctx, Vps, ""); err != nil {
+		return
+	}
+
+	n := strings.TrimSpace(s)
+	if !strings.HasPrefix(n, Vps.String()) {
+		err = &ResponseError{Command: Vps, Line: s}
+		return
+	}
+
+	n = strings.TrimSpace(strings.TrimPrefix(n, Vps.String()))
+	if v, err = strconv.Atoi(n); err != nil {
+		err = &ResponseError{Command: Vps, Line: s}
+		return
+	}
+
+	return
+}
+
+// VPSInfo holds the parsed VPS response, Date is the zero
+// time when the server does not report a definitions date
+type VPSInfo struct {
+	Version int
+	Date    time.Time
+}
+
+// VpsInfo returns the virus definitions version and date
+func (c *Client) VpsInfo() (v VPSInfo, err error) {
+	v, err = c.VpsInfoContext(context.Background())
+	return
+}
+
+// VpsInfoContext returns the virus definitions version and date,
+// fields that are not a recognised date are ignored
+func (c *Client) VpsInfoContext(ctx context.Context) (v VPSInfo, err error) {
+	var s string
+
+	if s, err = c.basicCmdContext(ctx, Vps, ""); err != nil {
+		return
+	}
+
+	f := strings.Fields(s)
+	if len(f) < 2 || f[0] != Vps.String() {
+		err = &ResponseError{Command: Vps, Line: s}
+		return
+	}
+
+	if v.Version, err = strconv.Atoi(f[1]); err != nil {
+		err = &ResponseError{Command: Vps, Line: s}
+		return
+	}
+
+	for _, t := range f[2:] {
+		for _, l := range vpsDateFmts {
+			if d, perr := time.Parse(l, t); perr == nil {
+				v.Date = d
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// GetPack returns packer options
+func (c *Client) GetPack() (p string, err error) {
+	p, err = c.GetPackContext(context.Background())
+	return
+}
+
+// GetPackContext returns packer options,
+// it is aborted when ctx is done
+func (c *Client) GetPackContext(ctx context.Context) (p string, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	p, err = c.optionsLocked(ctx, Pack)
+
+	return
+}
+
+// optionsLocked returns the option states reported by a PACK,
+// FLAGS or SENSITIVITY query, c.m must be held
+func (c *Client) optionsLocked(ctx context.Context, cmd Command) (r string, err error) {
+	var s string
+
+	if s, err = c.basicCmdLocked(ctx, cmd, ""); err != nil {
+		return
+	}
+
+	if !strings.HasPrefix(s, cmd.String()) {
+		err = &ResponseError{Command: cmd, Line: s}
+		return
+	}
+
+	r = s[cmd.Len():]
+
+	return
+}
+
+// SetPack sets packer options
+func (c *Client) SetPack(o PackOption, v bool) (err error) {
+	err = c.SetPackContext(context.Background(), o, v)
+	return
+}
+
+// SetPackContext sets packer options,
+// it is aborted when ctx is done
+func (c *Client) SetPackContext(ctx context.Context, o PackOption, v bool) (err error) {
+	var s string
+
+	if v {
+		s = o.Enable()
+	} else {
+		s = o.Disable()
+	}
+
+	_, err = c.basicCmdContext(ctx, Pack, s)
+
+	return
+}
+
+// SetPackOptions sets several packer options with a single command
+func (c *Client) SetPackOptions(opts map[PackOption]bool) (err error) {
+	err = c.SetPackOptionsContext(context.Background(), opts)
+	return
+}
+
+// SetPackOptionsContext sets several packer options with a single
+// command, the options are sent in their declaration order
+func (c *Client) SetPackOptionsContext(ctx context.Context, opts map[PackOption]bool) (err error) {
+	var w []optionState
+
+	if w, err = packStates(opts); err != nil {
+		return
+	}
+
+	err = c.setStatesContext(ctx, Pack, w)
+
+	return
+}
+
+// GetFlags returns scan flags
+func (c *Client) GetFlags() (f string, err error) {
+	f, err = c.GetFlagsContext(context.Background())
+	return
+}
+
+// GetFlagsContext returns scan flags,
+// it is aborted when ctx is done
+func (c *Client) GetFlagsContext(ctx context.Context) (f string, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	f, err = c.optionsLocked(ctx, Flags)
+
+	return
+}
+
+// SetFlags sets scan flags
+func (c *Client) SetFlags(o Flag, v bool) (err error) {
+	err = c.SetFlagsContext(context.Background(), o, v)
+	return
+}
+
+// SetFlagsContext sets scan flags,
+// it is aborted when ctx is done
+func (c *Client) SetFlagsContext(ctx context.Context, o Flag, v bool) (err error) {
+	var s string
+
+	if v {
+		s = o.Enable()
+	} else {
+		s = o.Disable()
+	}
+
+	_, err = c.basicCmdContext(ctx, Flags, s)
+
+	return
+}
+
+// SetFlagStates sets several scan flags with a single command
+func (c *Client) SetFlagStates(opts map[Flag]bool) (err error) {
+	err = c.SetFlagStatesContext(context.Background(), opts)
+	return
+}
+
+// SetFlagStatesContext sets several scan flags with a single
+// command, the flags are sent in their declaration order
+func (c *Client) SetFlagStatesContext(ctx context.Context, opts map[Flag]bool) (err error) {
+	var w []optionState
+
+	if w, err = flagStates(opts); err != nil {
+		return
+	}
+
+	err = c.setStatesContext(ctx, Flags, w)
+
+	return
+}
+
+// GetSensitivity returns scan sensitivity options
+func (c *Client) GetSensitivity() (f string, err error) {
+	f, err = c.GetSensitivityContext(context.Background())
+	return
+}
+
+// GetSensitivityContext returns scan sensitivity options,
+// it is aborted when ctx is done
+func (c *Client) GetSensitivityContext(ctx context.Context) (f string, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	f, err = c.optionsLocked(ctx, Sensitivity)
+
+	return
+}
+
+// SetSensitivity sets scan sensitivity
+func (c *Client) SetSensitivity(o SensiOption, v bool) (err error) {
+	err = c.SetSensitivityContext(context.Background(), o, v)
+	return
+}
+
+// SetSensitivityContext sets scan sensitivity,
+// it is aborted when ctx is done
+func (c *Client) SetSensitivityContext(ctx context.Context, o SensiOption, v bool) (err error) {
+	var s string
+
+	if v {
+		s = o.Enable()
+	} else {
+		s = o.Disable()
+	}
+
+	_, err = c.basicCmdContext(ctx, Sensitivity, s)
+
+	return
+}
+
+// SetSensitivityStates sets several sensitivity options with
+// a single command
+func (c *Client) SetSensitivityStates(opts map[SensiOption]bool) (err error) {
+	err = c.SetSensitivityStatesContext(context.Background(), opts)
+	return
+}
+
+// SetSensitivityStatesContext sets several sensitivity options
+// with a single command, the options are sent in their
+// declaration order
+func (c *Client) SetSensitivityStatesContext(ctx context.Context, opts map[SensiOption]bool) (err error) {
+	var w []optionState
+
+	if w, err = sensiStates(opts); err != nil {
+		return
+	}
+
+	err = c.setStatesContext(ctx, Sensitivity, w)
+
+	return
+}
+
+// GetExclude returns excluded path from scans
+func (c *Client) GetExclude() (r string, err error) {
+	r, err = c.GetExcludeContext(context.Background())
+	return
+}
+
+// GetExcludeContext returns excluded path from scans,
+// it is aborted when ctx is done
+func (c *Client) GetExcludeContext(ctx context.Context) (r string, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	r, err = c.excludeLocked(ctx)
+
+	return
+}
+
+// excludeLocked returns the excluded path, c.m must be held
+func (c *Client) excludeLocked(ctx context.Context) (r string, err error) {
+	var s string
+
+	if s, err = c.basicCmdLocked(ctx, Exclude, ""); err != nil {
+		return
+	}
+
+	if s == "" {
+		return
+	}
+
+	if !strings.HasPrefix(s, Exclude.String()) {
+		err = &ResponseError{Command: Exclude, Line: s}
+		return
+	}
+
+	s = strings.SplitN(s, "\n", 2)[0]
+	r = strings.TrimPrefix(strings.TrimPrefix(s, Exclude.String()), " ")
+
+	return
+}
+
+// GetExcludes returns all the paths excluded from scans,
+// the daemon may list them on one or several lines
+func (c *Client) GetExcludes(ctx context.Context) (r []string, err error) {
+	var s string
+
+	if s, err = c.basicCmdContext(ctx, Exclude, ""); err != nil {
+		return
+	}
+
+	for _, l := range strings.Split(s, "\n") {
+		if l == "" {
+			continue
+		}
+		if !strings.HasPrefix(l, Exclude.String()) {
+			r = nil
+			err = &ResponseError{Command: Exclude, Line: l}
+			return
+		}
+		r = append(r, splitExcludes(l[Exclude.Len():])...)
+	}
+
+	return
+}
+
+// splitExcludes splits a space separated list of absolute
+// paths, a space is only a separator before a "/" so paths
+// containing spaces are kept whole
+func splitExcludes(s string) (r []string) {
+	s = strings.TrimSpace(s)
+	for s != "" {
+		i := strings.Index(s, " /")
+		if i == -1 {
+			r = append(r, s)
+			break
+		}
+		if p := strings.TrimSpace(s[:i]); p != "" {
+			r = append(r, p)
+		}
+		s = strings.TrimSpace(s[i+1:])
+	}
+
+	return
+}
+
+// SetExclude sets the path excluded from scans, whether the
+// path is added to or replaces the current exclusions is up
+// to the daemon so use GetExcludes to read the result
+func (c *Client) SetExclude(p string) (err error) {
+	err = c.SetExcludeContext(context.Background(), p)
+	return
+}
+
+// SetExcludeContext sets the path excluded from scans, the
+// path must be absolute. It is aborted when ctx is done
+func (c *Client) SetExcludeContext(ctx context.Context, p string) (err error) {
+	if err = c.checkExclude(p); err != nil {
+		return
+	}
+
+	_, err = c.basicCmdContext(ctx, Exclude, p)
+	return
+}
+
+// checkExclude checks that p can be sent as an EXCLUDE path
+func (c *Client) checkExclude(p string) (err error) {
+	if p == "" || !filepath.IsAbs(p) {
+		err = fmt.Errorf(excludePathErr, p)
+		return
+	}
+
+	err = c.checkPath(p)
+
+	return
+}
+
+// CheckURL checks whether a given URL is malicious
+func (c *Client) CheckURL(u string) (r bool, err error) {
+	r, err = c.CheckURLContext(context.Background(), u)
+	return
+}
+
+// CheckURLContext checks whether a given URL is malicious, the
+// check is aborted when ctx is done or its deadline passes.
+// Error replies other than a blocked URL return a ResponseError.
+func (c *Client) CheckURLContext(ctx context.Context, u string) (r bool, err error) {
+	var ur URLResult
+
+	if ur, err = c.CheckURLResult(ctx, u); err != nil {
+		return
+	}
+
+	r = ur.Blocked
+
+	return
+}
+
+// URLResult holds the parsed CHECKURL reply, Reason holds
+// the detail the server gives for a blocked URL if any.
+// Replies of several lines are blocked if any line is, Raw
+// holds every line separated by newlines.
+type URLResult struct {
+	Blocked bool
+	Reason  string
+	Raw     string
+}
+
+// CheckURLResult checks whether a given URL is malicious and
+// returns the parsed reply. Error replies other than a blocked
+// URL return a ResponseError.
+func (c *Client) CheckURLResult(ctx context.Context, u string) (r URLResult, err error) {
+	var s string
+
+	if s, err = c.basicCmdContext(ctx, CheckURL, u); err != nil {
+		return
+	}
+
+	r, _, _ = parseURLReply(s, u)
+
+	return
+}
+
+// parseURLReply parses the CHECKURL reply s for u, code and
+// msg are those of the last line
+func parseURLReply(s, u string) (r URLResult, code int, msg string) {
+	var reasons []string
+
+	r.Raw = s
+	for _, l := range strings.Split(s, "\n") {
+		var perr error
+
+		if len(l) < 3 {
+			continue
+		}
+
+		if code, perr = strconv.Atoi(l[:3]); perr != nil {
+			continue
+		}
+
+		msg = strings.TrimSpace(strings.TrimPrefix(l[3:], "-"))
+		if strings.Contains(msg, urlBlockedResp) {
+			r.Blocked = true
+			if rs := urlReason(msg, u); rs != "" {
+				reasons = append(reasons, rs)
+			}
+		}
+	}
+	r.Reason = strings.Join(reasons, "; ")
+
+	return
+}
+
+// urlReason returns the fields of a blocked CHECKURL reply
+// other than the URL and the blocked marker
+func urlReason(msg, u string) string {
+	var f []string
+
+	for _, t := range strings.Split(msg, "\t") {
+		t = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(t), u))
+		t = strings.TrimSpace(strings.Replace(t, urlBlockedResp, "", 1))
+		if t != "" {
+			f = append(f, t)
+		}
+	}
+
+	return strings.Join(f, " ")
+}
+
+// CheckURLs checks each of urls over the client connection and
+// returns whether each one is blocked, URLs that fail to check
+// are left out of r and their errors are joined in err
+func (c *Client) CheckURLs(ctx context.Context, urls []string) (r map[string]bool, err error) {
+	var errs []error
+
+	r = make(map[string]bool, len(urls))
+	for _, u := range urls {
+		if cerr := ctx.Err(); cerr != nil {
+			errs = append(errs, cerr)
+			break
+		}
+
+		b, e := c.CheckURLContext(ctx, u)
+		if e != nil {
+			errs = append(errs, e)
+			continue
+		}
+		r[u] = b
+	}
+
+	err = errors.Join(errs...)
+
+	return
+}
+
+// CheckURLsWithTimeout checks each of urls bounding every check
+// by the per URL timeout, checks that fail or time out are
+// recorded in errs and the remaining URLs are still checked.
+// The connection is re-established after a timed out check as
+// the late reply would otherwise be read by the next check.
+func (c *Client) CheckURLsWithTimeout(urls []string, per time.Duration) (r map[string]bool, errs map[string]error) {
+	var rerr error
+
+	r = make(map[string]bool)
+	errs = make(map[string]error)
+
+	for _, u := range urls {
+		if rerr != nil {
+			errs[u] = rerr
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), per)
+		b, err := c.CheckURLContext(ctx, u)
+		cancel()
+
+		if err != nil {
+			errs[u] = err
+			if errors.Is(err, context.DeadlineExceeded) {
+				rerr = c.lockedReconnect(context.Background())
+			}
+			continue
+		}
+
+		r[u] = b
+	}
+
+	return
+}
+
+// Close sends QUIT and closes the server connection, QUIT is
+// best effort so only an error closing the connection is
+// returned. Calling Close more than once is safe.
+func (c *Client) Close() (err error) {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.closed = true
+	if c.tc == nil {
+		return
+	}
+
+	if !c.broken {
+		c.doBasicCmd(context.Background(), Quit, "")
+	}
+
+	if err = c.tc.Close(); errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	c.tc = nil
+
+	return
+}
+
+// bufConn reads through a sized buffer, writes and
+// closes go directly to the underlying connection
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufConn) Read(p []byte) (n int, err error) {
+	n, err = b.r.Read(p)
+	return
+}
+
+// absFilenames makes relative result filenames absolute, names that
+// start with the scanned path p are resolved against the working
+// directory, others against p. Archive items are left as is.
+func absFilenames(p string, r []*Response) {
+	root, err := filepath.Abs(p)
+	if err != nil {
+		return
+	}
+
+	cp := filepath.Clean(p)
+	for _, rs := range r {
+		if filepath.IsAbs(rs.Filename) {
+			continue
+		}
+		if rs.Filename == cp || strings.HasPrefix(rs.Filename, cp+string(filepath.Separator)) {
+			if f, err := filepath.Abs(rs.Filename); err == nil {
+				rs.Filename = f
+			}
+			continue
+		}
+		rs.Filename = filepath.Join(root, rs.Filename)
+	}
+}
+
+// isInfected reports whether st is treated as infected
+func (c *Client) isInfected(st ScanStatus) bool {
+	for _, s := range c.infectedStatuses {
+		if s == st {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPath verifies that p has no control characters and
+// resolves to a location under one of the allowed roots,
+// when roots are configured
+func (c *Client) checkPath(p string) (err error) {
+	var rp, rr string
+
+	if strings.IndexFunc(p, unicode.IsControl) != -1 {
+		err = fmt.Errorf("%w: %q", ErrInvalidPath, p)
+		return
+	}
+
+	if len(c.roots) == 0 {
+		return
+	}
+
+	if rp, err = resolvePath(p); err != nil {
+		return
+	}
+
+	for _, root := range c.roots {
+		if rr, err = resolvePath(root); err != nil {
+			return
+		}
+		if rp == rr || strings.HasPrefix(rp, rr+string(filepath.Separator)) {
+			return
+		}
+	}
+
+	err = fmt.Errorf("%w: %s", ErrPathNotAllowed, p)
+
+	return
+}
+
+// resolvePath returns the absolute clean form of p with symlinks
+// resolved, paths that do not exist are resolved from their
+// longest existing ancestor
+func resolvePath(p string) (r string, err error) {
+	var rest string
+
+	if r, err = filepath.Abs(p); err != nil {
+		return
+	}
+
+	for {
+		var d string
+		if d, err = filepath.EvalSymlinks(r); err == nil {
+			r = filepath.Join(d, rest)
+			return
+		}
+		if !os.IsNotExist(err) {
+			return
+		}
+		parent := filepath.Dir(r)
+		if parent == r {
+			err = nil
+			r = filepath.Join(r, rest)
+			return
+		}
+		rest = filepath.Join(filepath.Base(r), rest)
+		r = parent
+	}
+}
+
+// detectNetwork returns "tcp" for host:port addresses
+// and "unix" for everything else
+func detectNetwork(address string) string {
+	if strings.HasPrefix(address, "/") || strings.HasPrefix(address, ".") {
+		return "unix"
+	}
+
+	if _, port, err := net.SplitHostPort(address); err == nil {
+		if _, err = strconv.ParseUint(port, 10, 16); err == nil {
+			return "tcp"
+		}
+	}
+
+	return "unix"
+}
+
+// connect dials the server and reads the greeting
+func (c *Client) connect(ctx context.Context) (err error) {
+	var banner string
+
+	if c.conn, err = c.dial(ctx); err != nil {
+		err = contextErr(ctx, err)
+		return
+	}
+
+	stop := c.watch(ctx)
+	defer func() {
+		stop()
+		c.conn.SetDeadline(ZeroTime)
+	}()
+
+	c.setDeadline(ctx)
+
+	if c.bufSize > 0 {
+		c.tc = textproto.NewConn(&bufConn{
+			Conn: c.conn,
+			r:    bufio.NewReaderSize(c.conn, c.bufSize),
+		})
+	} else {
+		c.tc = textproto.NewConn(c.conn)
+	}
+
+	if _, banner, err = c.tc.ReadCodeLine(220); err != nil {
+		err = contextErr(ctx, err)
+		c.tc.Close()
+		c.tc = nil
+		return
+	}
+
+	if c.greetingValidator != nil {
+		if err = c.greetingValidator(banner); err != nil {
+			c.tc.Close()
+			c.tc = nil
+			return
+		}
+	}
+
+	c.greeting = banner
+	c.lastUsed = time.Now()
+
+	return
+}
+
+// connectBackoff connects retrying refused, missing socket, dropped
+// and timed out connections with exponential backoff and jitter up
+// to the configured number of attempts or until ctx is done
+func (c *Client) connectBackoff(ctx context.Context) (err error) {
+	for i := 1; ; i++ {
+		if err = c.connect(ctx); err == nil || i >= c.connectAttempts || !retryableConnErr(err) {
+			return
+		}
+
+		t := time.NewTimer(c.backoff(i - 1))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			err = ctx.Err()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// retryableConnErr reports whether a connection error is transient
+func retryableConnErr(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT) || errors.Is(err, io.EOF) {
+		return true
+	}
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+// reconnect drops the current connection and connects again
+func (c *Client) reconnect(ctx context.Context) (err error) {
+	if c.tc != nil {
+		c.tc.Close()
+		c.tc = nil
+	}
+
+	if err = c.connect(ctx); err == nil {
+		c.broken = false
+	}
+
+	if c.metrics != nil {
+		c.metrics.OnReconnect(err)
+	}
+
+	return
+}
+
+// withRetry runs f through withReconnect retrying it up to the
+// cmd retries when it fails with a transient error, the connection
+// is re-established after timeouts and closed connections. c.m
+// must be held.
+func (c *Client) withRetry(ctx context.Context, cmd Command, f func() error) (err error) {
+	for i := 0; ; i++ {
+		err = c.withReconnect(ctx, cmd, f)
+		if err == nil || i >= c.cmdRetries || cmd == Quit || ctxDone(ctx) || !isTransient(err) {
+			return
+		}
+
+		t := time.NewTimer(c.backoff(i))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		var re *ResponseError
+		if !errors.As(err, &re) {
+			if rerr := c.reconnect(ctx); rerr != nil {
+				return
+			}
+		}
+	}
+}
+
+// isTransient reports whether err may succeed when retried,
+// timeouts, closed connections and 4xx replies are transient
+func isTransient(err error) bool {
+	var re *ResponseError
+	if errors.As(err, &re) {
+		return re.Code >= 400 && re.Code < 500
+	}
 
-// Vps returns the virus definitions (VPS) version
-func (c *Client) Vps() (v int, err error) {
-	var s string
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
 
-	if s, err = c.basicCmd(Vps, ""); err != nil {
+	return isConnErr(err)
+}
+
+// withReconnect runs f and when auto reconnect is enabled replays
+// it once on a new connection if the connection was closed or was
+// left broken by a cancelled command, c.m must be held
+func (c *Client) withReconnect(ctx context.Context, cmd Command, f func() error) (err error) {
+	if c.tc == nil && (c.closed || !c.autoReconnect) {
+		err = net.ErrClosed
 		return
 	}
 
-	if !strings.HasPrefix(s, Vps.String()) {
-		err = fmt.Errorf(invalidRespErr, s)
+	if c.broken && !c.autoReconnect && cmd != Quit {
+		err = ErrBrokenConnection
 		return
 	}
 
-	if v, err = strconv.Atoi(s[4:]); err != nil {
-		err = fmt.Errorf(invalidRespErr, s)
+	if !c.autoReconnect || cmd == Quit {
+		err = f()
 		return
 	}
 
-	return
-}
-
-// GetPack returns packer options
-func (c *Client) GetPack() (p string, err error) {
-	var s string
+	if c.broken || c.tc == nil || c.idleExpired() {
+		if err = c.reconnect(ctx); err != nil {
+			return
+		}
+	}
 
-	if s, err = c.basicCmd(Pack, ""); err != nil {
+	if err = f(); err == nil || ctxDone(ctx) || !isConnErr(err) {
 		return
 	}
 
-	if !strings.HasPrefix(s, Pack.String()) {
-		err = fmt.Errorf(invalidRespErr, s)
+	if rerr := c.reconnect(ctx); rerr != nil {
 		return
 	}
 
-	p = s[Pack.Len():]
+	err = f()
 
 	return
 }
 
-// SetPack sets packer options
-func (c *Client) SetPack(o PackOption, v bool) (err error) {
-	var s string
+// idleExpired reports whether the connection has been idle
+// for longer than the maximum idle time
+func (c *Client) idleExpired() bool {
+	return c.maxIdle > 0 && !c.lastUsed.IsZero() && time.Since(c.lastUsed) > c.maxIdle
+}
 
-	if v {
-		s = o.Enable()
-	} else {
-		s = o.Disable()
-	}
+// lockedReconnect reconnects while holding the client mutex
+func (c *Client) lockedReconnect(ctx context.Context) (err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
 
-	_, err = c.basicCmd(Pack, s)
+	err = c.reconnect(ctx)
 
 	return
 }
 
-// GetFlags returns scan flags
-func (c *Client) GetFlags() (f string, err error) {
-	var s string
-
-	if s, err = c.basicCmd(Flags, ""); err != nil {
-		return
+// isConnErr reports whether err was caused by a closed connection
+func isConnErr(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) {
+		return true
 	}
 
-	if !strings.HasPrefix(s, Flags.String()) {
-		err = fmt.Errorf(invalidRespErr, s)
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "write"
+}
+
+// watch aborts blocked reads and writes on the connection
+// once ctx is done, stop must be called when the command ends
+func (c *Client) watch(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		stop = func() {}
 		return
 	}
 
-	f = s[Flags.Len():]
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	stop = func() {
+		close(done)
+		<-exited
+	}
 
 	return
 }
 
-// SetFlags sets scan flags
-func (c *Client) SetFlags(o Flag, v bool) (err error) {
-	var s string
-
-	if v {
-		s = o.Enable()
-	} else {
-		s = o.Disable()
+// ctxDone reports whether ctx is done or its deadline has
+// passed, the read deadline may fire before ctx.Err is set
+func ctxDone(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
 	}
 
-	_, err = c.basicCmd(Flags, s)
-
-	return
+	d, ok := ctx.Deadline()
+	return ok && !time.Now().Before(d)
 }
 
-// GetSensitivity returns scan sensitivity options
-func (c *Client) GetSensitivity() (f string, err error) {
-	var s string
-
-	if s, err = c.basicCmd(Sensitivity, ""); err != nil {
-		return
+// contextErr returns the ctx error when err was caused
+// by ctx being done or its deadline passing
+func contextErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
 	}
 
-	if !strings.HasPrefix(s, Sensitivity.String()) {
-		err = fmt.Errorf(invalidRespErr, s)
-		return
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
-	f = s[Sensitivity.Len():]
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return context.DeadlineExceeded
+		}
+	}
 
-	return
+	return err
 }
 
-// SetSensitivity sets scan sensitivity
-func (c *Client) SetSensitivity(o SensiOption, v bool) (err error) {
-	var s string
+// cmdTimeoutKey is the context key of a per call cmd timeout
+type cmdTimeoutKey struct{}
 
-	if v {
-		s = o.Enable()
-	} else {
-		s = o.Disable()
+// ContextWithCmdTimeout returns a copy of ctx that overrides the
+// client cmd timeout with d for the commands it is passed to,
+// unlike a context deadline it may be longer than the default
+func ContextWithCmdTimeout(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
 	}
 
-	_, err = c.basicCmd(Sensitivity, s)
-
-	return
+	return context.WithValue(ctx, cmdTimeoutKey{}, d)
 }
 
-// GetExclude returns excluded path from scans
-func (c *Client) GetExclude() (r string, err error) {
-	var s string
+// setDeadline sets the IO deadline to the command timeout, or
+// the ctx override of it, or the ctx deadline whichever comes first
+func (c *Client) setDeadline(ctx context.Context) {
+	timeout := c.cmdTimeout
+	if d, ok := ctx.Value(cmdTimeoutKey{}).(time.Duration); ok {
+		timeout = d
+	}
 
-	if s, err = c.basicCmd(Exclude, ""); err != nil {
-		return
+	t := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		t = d
 	}
 
-	if s == "" {
-		return
+	c.conn.SetDeadline(t)
+
+	if ctx.Err() != nil {
+		c.conn.SetDeadline(aLongTimeAgo)
 	}
+}
 
-	if !strings.HasPrefix(s, Exclude.String()) {
-		err = fmt.Errorf(invalidRespErr, s)
-		return
+func (c *Client) dial(ctx context.Context) (conn net.Conn, err error) {
+	d := &net.Dialer{
+		Timeout: c.connTimeout,
 	}
 
-	r = s[Exclude.Len()+1:]
+	dialFn := d.DialContext
+	if c.dialer != nil {
+		dialFn = func(ctx context.Context, network, address string) (net.Conn, error) {
+			dctx, cancel := context.WithTimeout(ctx, c.connTimeout)
+			defer cancel()
+			return c.dialer(dctx, network, address)
+		}
+	}
 
+	for i := 0; i <= c.connRetries; i++ {
+		conn, err = dialFn(ctx, c.network, c.address)
+		if err == nil && c.tlsConfig != nil {
+			conn, err = c.handshake(ctx, conn)
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() && i < c.connRetries {
+			t := time.NewTimer(c.backoff(i))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				err = ctx.Err()
+				return
+			case <-t.C:
+			}
+			continue
+		}
+		break
+	}
 	return
 }
 
-// SetExclude returns excluded path from scans
-func (c *Client) SetExclude(p string) (err error) {
-	_, err = c.basicCmd(Exclude, p)
-	return
-}
+// handshake wraps conn in a TLS client connection and runs the
+// handshake within the connection timeout, the server name is
+// taken from the address when the config does not set one
+func (c *Client) handshake(ctx context.Context, conn net.Conn) (tc net.Conn, err error) {
+	cfg := c.tlsConfig
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		cfg = cfg.Clone()
+		if cfg.ServerName, _, err = net.SplitHostPort(c.address); err != nil {
+			conn.Close()
+			return
+		}
+	}
 
-// CheckURL checks whether a given URL is malicious
-func (c *Client) CheckURL(u string) (r bool, err error) {
-	var s string
+	hctx, cancel := context.WithTimeout(ctx, c.connTimeout)
+	defer cancel()
 
-	if s, err = c.basicCmd(CheckURL, u); err != nil {
+	t := tls.Client(conn, cfg)
+	if err = t.HandshakeContext(hctx); err != nil {
+		conn.Close()
 		return
 	}
+	tc = t
 
-	r = strings.HasSuffix(s, urlBlockedResp)
+	return
+}
 
+func (c *Client) basicCmd(cmd Command, o string) (r string, err error) {
+	r, err = c.basicCmdContext(context.Background(), cmd, o)
 	return
 }
 
-// Close closes the server connection
-func (c *Client) Close() (err error) {
-	_, err = c.basicCmd(Quit, "")
+func (c *Client) basicCmdContext(ctx context.Context, cmd Command, o string) (r string, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
 
-	c.tc.Close()
+	r, err = c.basicCmdLocked(ctx, cmd, o)
 
 	return
 }
 
-func (c *Client) dial(ctx context.Context) (conn net.Conn, err error) {
-	d := &net.Dialer{
-		Timeout: c.connTimeout,
+// basicCmdLocked runs a basic command with tracing, metrics and
+// retries, c.m must be held
+func (c *Client) basicCmdLocked(ctx context.Context, cmd Command, o string) (r string, err error) {
+	if c.tracer != nil {
+		var end func(int, error)
+		ctx, end = c.tracer(ctx, cmd, o)
+		defer func() { end(0, err) }()
 	}
 
-	for i := 0; i <= c.connRetries; i++ {
-		conn, err = d.DialContext(ctx, "unix", c.address)
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			time.Sleep(c.connSleep)
-			continue
-		}
-		break
+	if c.metrics != nil {
+		start := time.Now()
+		defer func() { c.metrics.OnCommand(cmd, time.Since(start), err) }()
 	}
+
+	err = c.withRetry(ctx, cmd, func() (cerr error) {
+		r, cerr = c.doBasicCmd(ctx, cmd, o)
+		return
+	})
+
 	return
 }
 
-func (c *Client) basicCmd(cmd Command, o string) (r string, err error) {
+func (c *Client) doBasicCmd(ctx context.Context, cmd Command, o string) (r string, err error) {
 	var id uint
+	var code int
+	var msg string
 
-	if o == "" {
-		id, err = c.tc.Cmd("%s", cmd)
-	} else {
-		id, err = c.tc.Cmd("%s %s", cmd, o)
+	l := cmd.String()
+	if o != "" {
+		l = fmt.Sprintf("%s %s", cmd, o)
 	}
 
-	if err != nil {
+	stop := c.watch(ctx)
+	defer func() {
+		stop()
+		c.conn.SetDeadline(ZeroTime)
+		if err != nil {
+			if ctxDone(ctx) {
+				c.broken = true
+			}
+			err = contextErr(ctx, err)
+			err = responseErr(cmd, o, err)
+			err = &CommandError{
+				Client:     c.name,
+				Command:    l,
+				Transcript: c.lastTranscript(),
+				Err:        err,
+			}
+		}
+	}()
+
+	c.beginCmd()
+
+	if id, err = c.send(l); err != nil {
 		return
 	}
 
 	c.tc.StartResponse(id)
 	defer c.tc.EndResponse(id)
-	defer c.conn.SetDeadline(ZeroTime)
 
 	if cmd == Quit {
 		return
 	}
 
 	if cmd == CheckURL {
-		c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if r, err = c.tc.ReadLine(); err != nil {
-			return
+		// Verdicts may span several lines, every line but
+		// the last has a "-" after the code
+		for {
+			var l string
+
+			c.setDeadline(ctx)
+			if l, err = c.readLine(); err != nil {
+				return
+			}
+			if r != "" {
+				r += "\n"
+			}
+			r += l
+			if len(l) < 4 || l[3] != '-' {
+				c.setStatus(l)
+				if ur, code, msg := parseURLReply(r, o); !ur.Blocked && code >= 400 {
+					err = &ResponseError{Command: CheckURL, Arg: o, Line: msg, Code: code}
+				}
+				return
+			}
 		}
-		return
 	}
 
 	// Read Opening response
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if _, _, err = c.tc.ReadCodeLine(210); err != nil {
+	c.setDeadline(ctx)
+	if code, msg, err = c.readCodeLine(210); err != nil {
 		return
 	}
+	if c.captureFraming {
+		c.framing.Open = fmt.Sprintf("%d %s", code, msg)
+	}
 
 	// Read actual response
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if r, err = c.tc.ReadLine(); err != nil {
+	c.setDeadline(ctx)
+	if r, err = c.readLine(); err != nil {
 		return
 	}
 
 	if cmd == Exclude {
 		if r == excludeOKResp {
+			if c.captureFraming {
+				c.framing.Close = r
+			}
+			c.setStatus(r)
 			r = ""
 			return
 		}
+
+		// Exclusions may be listed on several lines
+		if o == "" {
+			for {
+				var l string
+
+				c.setDeadline(ctx)
+				if l, err = c.readLine(); err != nil {
+					return
+				}
+				if l == excludeOKResp {
+					if c.captureFraming {
+						c.framing.Close = l
+					}
+					c.setStatus(l)
+					return
+				}
+				if !strings.HasPrefix(l, Exclude.String()) {
+					err = &ResponseError{Command: Exclude, Line: l}
+					return
+				}
+				r += "\n" + l
+			}
+		}
 	}
 
 	// Read Closing response
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if _, _, err = c.tc.ReadCodeLine(200); err != nil {
+	c.setDeadline(ctx)
+	if code, msg, err = c.readCodeLine(200); err != nil {
 		return
 	}
+	if c.captureFraming {
+		c.framing.Close = fmt.Sprintf("%d %s", code, msg)
+	}
+	c.lastCode, c.lastStatus = code, msg
+	c.lastDuration = time.Since(c.cmdStart)
 
 	return
 }
 
 func (c *Client) fileCmd(p string) (r []*Response, err error) {
+	r, err = c.fileCmdContext(context.Background(), p)
+	return
+}
+
+func (c *Client) fileCmdContext(ctx context.Context, p string) (r []*Response, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	r, err = c.fileCmdLocked(ctx, p)
+
+	return
+}
+
+// fileCmdLocked runs a SCAN with tracing, metrics and retries,
+// c.m must be held
+func (c *Client) fileCmdLocked(ctx context.Context, p string) (r []*Response, err error) {
+	if c.tracer != nil {
+		var end func(int, error)
+		ctx, end = c.tracer(ctx, Scan, p)
+		defer func() { end(len(r), err) }()
+	}
+
+	if c.metrics != nil {
+		start := time.Now()
+		defer func() { c.metrics.OnCommand(Scan, time.Since(start), err) }()
+	}
+
+	err = c.withRetry(ctx, Scan, func() (cerr error) {
+		r, cerr = c.doFileCmd(ctx, p, nil)
+		return
+	})
+
+	return
+}
+
+func (c *Client) doFileCmd(ctx context.Context, p string, emit func(*Response)) (r []*Response, err error) {
+	var lines int
 	var id uint
 	var l string
+	var code int
+	var msg string
 	var gerr error
+	var opened bool
+
+	cl := fmt.Sprintf("%s %s", Scan, p)
+
+	stop := c.watch(ctx)
+	defer func() {
+		stop()
+		if err != nil && ctxDone(ctx) {
+			c.broken = !c.drain(opened)
+		}
+		c.conn.SetDeadline(ZeroTime)
+		if err != nil {
+			err = &CommandError{
+				Client:     c.name,
+				Command:    cl,
+				Transcript: c.lastTranscript(),
+				Err:        responseErr(Scan, p, contextErr(ctx, err)),
+			}
+		}
+	}()
 
-	if id, err = c.tc.Cmd("%s %s", Scan, p); err != nil {
+	c.beginCmd()
+
+	if id, err = c.send(cl); err != nil {
 		return
 	}
 
 	c.tc.StartResponse(id)
 	defer c.tc.EndResponse(id)
-	defer c.conn.SetDeadline(ZeroTime)
 
 	// Read Opening response
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	if _, _, err = c.tc.ReadCodeLine(210); err != nil {
+	c.setDeadline(ctx)
+	if code, msg, err = c.readCodeLine(210); err != nil {
 		return
 	}
+	opened = true
+	if c.captureFraming {
+		c.framing.Open = fmt.Sprintf("%d %s", code, msg)
+	}
 
 	// Read actual response
 	for {
-		c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if l, err = c.tc.ReadLine(); err != nil {
+		var rs *Response
+		var done bool
+
+		c.setDeadline(ctx)
+		if l, err = c.readLine(); err != nil {
 			return
 		}
-		if strings.HasPrefix(l, Scan.String()) {
-			if mb := responseRe.FindStringSubmatch(l); mb == nil {
-				gerr = fmt.Errorf(invalidRespErr, l)
-				continue
-			} else {
-				rs := Response{}
-				if strings.HasPrefix(mb[3], "0.") {
-					rs.Filename = mb[1]
-				} else {
-					pts := strings.SplitN(mb[1], "|", 2)
-					rs.Filename = pts[0]
-					rs.ArchiveItem = pts[1]
-				}
-				rs.Status = mb[2]
-				rs.Infected = mb[2] == "L"
-				if rs.Infected {
-					rs.Signature = strings.TrimPrefix(mb[4], "0 ")
-				} else {
-					rs.Signature = mb[4]
-				}
-				rs.Raw = l
-
-				r = append(r, &rs)
+		if c.maxResults > 0 && lines >= c.maxResults && !isScanOK(l) {
+			c.broken = true
+			err = fmt.Errorf("%w: %d", ErrTooManyResults, c.maxResults)
+			return
+		}
+		lines++
+		if rs, done, err = ParseResponseLine(l); err != nil {
+			gerr = err
+			err = nil
+			continue
+		}
+		if done {
+			if c.captureFraming {
+				c.framing.Close = l
 			}
-		} else if l == scanOkResp {
+			c.setStatus(l)
 			break
-		} else {
-			gerr = fmt.Errorf(invalidRespErr, l)
 		}
+		if len(c.infectedStatuses) > 0 {
+			rs.Infected = c.isInfected(rs.ScanStatus)
+		}
+		if c.resultHook != nil {
+			c.resultHook(rs)
+		}
+		if c.metrics != nil {
+			c.metrics.OnScanResult(rs)
+		}
+		if emit != nil {
+			emit(rs)
+			continue
+		}
+		r = append(r, rs)
 	}
 
 	if err == nil && gerr != nil {
@@ -680,17 +2334,133 @@ func (c *Client) fileCmd(p string) (r []*Response, err error) {
 	return
 }
 
-// NewClient creates and returns a new instance of Client
-func NewClient(ctx context.Context, address string, connTimeOut, ioTimeOut time.Duration) (c *Client, err error) {
-	if address == "" {
-		address = AvastSock
+// drain reads the rest of a cancelled SCAN response within the
+// drain grace period so that the connection can be reused, it
+// reports whether the response was read to its end
+func (c *Client) drain(opened bool) bool {
+	if c.drainGrace <= 0 {
+		return false
 	}
 
-	if _, err = os.Stat(address); os.IsNotExist(err) {
-		err = fmt.Errorf(unixSockErr, address)
+	c.conn.SetDeadline(time.Now().Add(c.drainGrace))
+
+	if !opened {
+		code, _, err := c.tc.ReadCodeLine(210)
+		if err != nil {
+			_, ok := err.(*textproto.Error)
+			return ok && code != 0
+		}
+	}
+
+	for {
+		l, err := c.tc.ReadLine()
+		if err != nil {
+			return false
+		}
+		if isScanOK(l) {
+			return true
+		}
+	}
+}
+
+// isScanOK reports whether l is the closing line of a SCAN
+// response, the daemon may append detail such as a file count
+// and trailing CR characters are ignored
+func isScanOK(l string) bool {
+	l = strings.TrimRight(l, "\r")
+	return l == scanOkResp || strings.HasPrefix(l, scanOkResp+" ")
+}
+
+// setStatus records the closing line l of a command and
+// the time taken since the command was sent
+func (c *Client) setStatus(l string) {
+	c.lastDuration = time.Since(c.cmdStart)
+	c.lastCode, c.lastStatus = 0, l
+	if len(l) > 4 && l[3] == ' ' {
+		if code, err := strconv.Atoi(l[:3]); err == nil {
+			c.lastCode, c.lastStatus = code, l[4:]
+		}
+	}
+}
+
+// archivePath splits a SCAN filename into the outer file and the
+// archive members from outermost to innermost, members are joined
+// with "|>" and depth is the number of members so a "|" in the
+// outer file name is kept
+func archivePath(name string, depth int) (p []string) {
+	if depth <= 0 {
+		p = []string{name}
+		return
+	}
+
+	pts := strings.Split(name, archiveSep)
+	if len(pts) <= depth {
+		p = pts
+		return
+	}
+
+	n := len(pts) - depth
+	p = append([]string{strings.Join(pts[:n], archiveSep)}, pts[n:]...)
+
+	return
+}
+
+// ParseResponseLine parses a single line of SCAN output, done
+// is true when the line is the closing OK response
+func ParseResponseLine(l string) (r *Response, done bool, err error) {
+	if isScanOK(l) {
+		done = true
+		return
+	}
+
+	if !strings.HasPrefix(l, Scan.String()) {
+		err = &ResponseError{Command: Scan, Line: l}
+		return
+	}
+
+	// Some daemon builds emit stray CR characters within
+	// and at the end of the line
+	mb := responseRe.FindStringSubmatch(strings.Replace(l, "\r", "", -1))
+	if mb == nil {
+		err = &ResponseError{Command: Scan, Line: l}
 		return
 	}
 
+	r = &Response{Command: Scan}
+	r.Depth, _ = strconv.ParseFloat(mb[3], 64)
+	r.ArchivePath = archivePath(mb[1], int(r.Depth))
+	r.Filename = r.ArchivePath[0]
+	if len(r.ArchivePath) > 1 {
+		r.ArchiveItem = mb[1][len(r.Filename)+1:]
+	}
+	r.RawFilename = r.Filename
+	r.Status = mb[2]
+	r.ScanStatus = scanStatus(mb[2])
+	r.Infected = mb[2] == "L"
+	r.Errored = mb[2] == "E"
+	if r.Infected {
+		r.Signature = strings.TrimPrefix(mb[4], "0 ")
+	} else {
+		r.Signature = mb[4]
+	}
+	r.Raw = l
+
+	return
+}
+
+// NewClient creates and returns a new instance of Client,
+// ctx bounds the whole connection including dial retries,
+// retry sleeps and reading the server greeting.
+// The address is either a unix socket path or a TCP host:port
+// such as "127.0.0.1:5036" or "[::1]:5036", WithNetwork
+// overrides the detected network. Options are applied after
+// the positional timeouts so WithConnTimeout and WithCmdTimeout
+// take precedence over connTimeOut and ioTimeOut.
+func NewClient(ctx context.Context, address string, connTimeOut, ioTimeOut time.Duration, opts ...Option) (c *Client, err error) {
+	if address == "" {
+		address = AvastSock
+	}
+
 	if connTimeOut == 0 {
 		connTimeOut = DefaultTimeout
 	}
@@ -699,29 +2469,110 @@ func NewClient(ctx context.Context, address string, connTimeOut, ioTimeOut time.
 		ioTimeOut = DefaultCmdTimeout
 	}
 
-	c = &Client{
-		address:     address,
-		connTimeout: connTimeOut,
-		connSleep:   DefaultSleep,
-		cmdTimeout:  ioTimeOut,
+	cl := &Client{
+		address:       address,
+		connTimeout:   connTimeOut,
+		connSleep:     DefaultSleep,
+		cmdTimeout:    ioTimeOut,
+		autoReconnect: true,
+	}
+
+	for _, o := range opts {
+		o(cl)
+	}
+
+	if cl.network == "" {
+		cl.network = detectNetwork(address)
+	}
+
+	if cl.tlsConfig != nil && cl.network == "unix" {
+		err = errors.New(tlsUnixErr)
+		return
+	}
+
+	switch cl.network {
+	case "unix":
+		if _, err = os.Stat(address); os.IsNotExist(err) && cl.connectAttempts < 2 && cl.dialer == nil {
+			err = fmt.Errorf(unixSockErr, address)
+			return
+		}
+	case "tcp":
+	default:
+		err = fmt.Errorf(unsupportedNetErr, cl.network)
+		return
 	}
 
+	c = cl
+
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	if c.conn, err = c.dial(ctx); err != nil {
-		return
+	if err = c.connectBackoff(ctx); err != nil && c.network == "unix" && errors.Is(err, syscall.ENOENT) {
+		err = fmt.Errorf(unixSockErr, address)
 	}
 
-	c.conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	defer c.conn.SetDeadline(ZeroTime)
+	return
+}
+
+// Clone creates and returns a new instance of Client
+// connected to the same address with the same settings,
+// the connection and per command state are not copied
+func (c *Client) Clone(ctx context.Context) (n *Client, err error) {
+	c.m.Lock()
+	cl := &Client{
+		name:              c.name,
+		network:           c.network,
+		address:           c.address,
+		connTimeout:       c.connTimeout,
+		connRetries:       c.connRetries,
+		connSleep:         c.connSleep,
+		cmdTimeout:        c.cmdTimeout,
+		bufSize:           c.bufSize,
+		roots:             append([]string(nil), c.roots...),
+		limiter:           c.limiter,
+		parseRetries:      c.parseRetries,
+		absPaths:          c.absPaths,
+		captureFraming:    c.captureFraming,
+		infectedStatuses:  append([]ScanStatus(nil), c.infectedStatuses...),
+		syslog:            c.syslog,
+		syslogSDID:        c.syslogSDID,
+		connectAttempts:   c.connectAttempts,
+		backoffBase:       c.backoffBase,
+		backoffMax:        c.backoffMax,
+		maxIdle:           c.maxIdle,
+		transcriptMax:     c.transcriptMax,
+		resultHook:        c.resultHook,
+		greetingValidator: c.greetingValidator,
+		drainGrace:        c.drainGrace,
+		autoReconnect:     c.autoReconnect,
+		logger:            c.logger,
+		tracer:            c.tracer,
+		metrics:           c.metrics,
+		tlsConfig:         c.tlsConfig,
+		cmdRetries:        c.cmdRetries,
+		dialer:            c.dialer,
+		maxResults:        c.maxResults,
+		tmpDir:            c.tmpDir,
+		scanRoot:          c.scanRoot,
+		classifier:        c.classifier,
+	}
+	c.m.Unlock()
 
-	c.tc = textproto.NewConn(c.conn)
+	cl.m.Lock()
+	defer cl.m.Unlock()
 
-	if _, _, err = c.tc.ReadCodeLine(220); err != nil {
-		c.tc.Close()
+	if err = cl.connectBackoff(ctx); err != nil {
 		return
 	}
+	n = cl
+
+	return
+}
 
+// NewClientWithOptions creates and returns a new instance of
+// Client configured by opts, the default timeouts are used
+// unless WithConnTimeout or WithCmdTimeout are given
+func NewClientWithOptions(ctx context.Context, address string, opts ...Option) (c *Client, err error) {
+	c, err = NewClient(ctx, address, 0, 0, opts...)
 	return
 }
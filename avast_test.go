@@ -10,12 +10,33 @@ Avast - Golang Avast client
 package avast
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/baruwa-enterprise/avast/avasttest"
+	flag "github.com/spf13/pflag"
 )
 
 const (
@@ -37,11 +58,26 @@ type FlagTestKey struct {
 	out string
 }
 
+type ScanStatusTestKey struct {
+	in  ScanStatus
+	out string
+}
+
 type PackOptionTestKey struct {
 	in  PackOption
 	out string
 }
 
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	cr.reads++
+	return cr.r.Read(p)
+}
+
 var TestCommands = []CommandTestKey{
 	{Scan, "SCAN"},
 	{Vps, "VPS"},
@@ -79,6 +115,13 @@ var TestFlags = []FlagTestKey{
 	{Flag(100), ""},
 }
 
+var TestScanStatuses = []ScanStatusTestKey{
+	{StatusClean, "clean"},
+	{StatusInfected, "infected"},
+	{StatusError, "error"},
+	{ScanStatus(100), ""},
+}
+
 var TestPackOptions = []PackOptionTestKey{
 	{Mime, "mime"},
 	{Zip, "zip"},
@@ -161,6 +204,41 @@ func TestPackOption(t *testing.T) {
 	}
 }
 
+func TestScanStatus(t *testing.T) {
+	for _, tt := range TestScanStatuses {
+		if s := tt.in.String(); s != tt.out {
+			t.Errorf("%q.String() = %q, want %q", tt.in, s, tt.out)
+		}
+	}
+}
+
+func TestInfectedStatuses(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{
+			"210 SCAN DATA",
+			"SCAN /tmp/clean.txt\t[+]0.0",
+			"SCAN /tmp/eicar.com\t[L]0.0\t0 EICAR Test-NOT virus!!!",
+			"SCAN /tmp/locked.zip\t[E]0.0\tError 42110 Archive is password protected",
+			scanOkResp,
+		}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithInfectedStatuses(StatusInfected, StatusError))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.Scan("/tmp")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	expected := []bool{false, true, true}
+	for i, rs := range r {
+		if rs.Infected != expected[i] {
+			t.Errorf("%q.Infected = %t, want %t", rs.Filename, rs.Infected, expected[i])
+		}
+	}
+}
+
 func TestBasics(t *testing.T) {
 	address := os.Getenv("AVAST_ADDRESS")
 	if address == "" {
@@ -567,3 +645,3075 @@ func TestCheckURL(t *testing.T) {
 		t.Skip("skipping test; $AVAST_ADDRESS not set")
 	}
 }
+
+func BenchmarkBufferSize(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&buf, "SCAN /var/spool/testfiles/file-%05d.txt\t[+]0.0\r\n", i)
+	}
+	buf.WriteString(scanOkResp + "\r\n")
+	data := buf.Bytes()
+
+	for _, size := range []int{0, 16 * 1024, 64 * 1024} {
+		b.Run(fmt.Sprintf("size-%d", size), func(b *testing.B) {
+			var reads int
+			for i := 0; i < b.N; i++ {
+				cr := &countingReader{r: bytes.NewReader(data)}
+				var r io.Reader = cr
+				if size > 0 {
+					r = bufio.NewReaderSize(cr, size)
+				}
+				tr := textproto.NewReader(bufio.NewReader(r))
+				for {
+					l, e := tr.ReadLine()
+					if e != nil {
+						b.Fatalf("An error should not be returned: %s", e)
+					}
+					if l == scanOkResp {
+						break
+					}
+				}
+				reads += cr.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	link := root + "/escape"
+	if e := os.Symlink(outside, link); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c := &Client{}
+	if e := c.checkPath(outside); e != nil {
+		t.Errorf("c.checkPath(%q) = %v, want nil", outside, e)
+	}
+	c = &Client{roots: []string{root}}
+	tests := []struct {
+		in      string
+		allowed bool
+	}{
+		{root, true},
+		{root + "/file.txt", true},
+		{root + "/sub/../file.txt", true},
+		{root + "/../file.txt", false},
+		{root + "x/file.txt", false},
+		{link + "/file.txt", false},
+		{outside, false},
+	}
+	for _, tt := range tests {
+		e := c.checkPath(tt.in)
+		if tt.allowed && e != nil {
+			t.Errorf("c.checkPath(%q) = %v, want nil", tt.in, e)
+		}
+		if !tt.allowed && !errors.Is(e, ErrPathNotAllowed) {
+			t.Errorf("c.checkPath(%q) = %v, want %v", tt.in, e, ErrPathNotAllowed)
+		}
+	}
+}
+
+func TestResponseDepth(t *testing.T) {
+	tests := []struct {
+		in    string
+		depth float64
+	}{
+		{"SCAN /tmp/clean.txt\t[+]0.0", 0},
+		{"SCAN /tmp/eicar.zip|>eicar.com\t[L]1.0\t0 EICAR Test-NOT virus!!!", 1},
+		{"SCAN /tmp/a.zip|>b.tar|>c.com\t[E]2.0\tError 42110 Archive is password protected", 2},
+	}
+	for _, tt := range tests {
+		r, _, e := ParseResponseLine(tt.in)
+		if e != nil {
+			t.Fatalf("ParseResponseLine(%q) returned error: %s", tt.in, e)
+		}
+		if r.Depth != tt.depth {
+			t.Errorf("ParseResponseLine(%q).Depth = %f, want %f", tt.in, r.Depth, tt.depth)
+		}
+	}
+}
+
+func TestParseScanStatus(t *testing.T) {
+	tests := []struct {
+		in   string
+		st   ScanStatus
+		name string
+		err  bool
+	}{
+		{"+", StatusClean, "clean", false},
+		{"L", StatusInfected, "infected", false},
+		{"E", StatusError, "error", false},
+		{"X", 0, "", true},
+		{"", 0, "", true},
+	}
+	for _, tt := range tests {
+		st, e := ParseScanStatus(tt.in)
+		if st != tt.st || st.String() != tt.name || (e != nil) != tt.err {
+			t.Errorf("ParseScanStatus(%q) = %s, %v, want %s", tt.in, st, e, tt.name)
+		}
+	}
+}
+
+func TestParseResponseLine(t *testing.T) {
+	tests := []struct {
+		in        string
+		done      bool
+		err       bool
+		filename  string
+		item      string
+		status    string
+		signature string
+		infected  bool
+	}{
+		{scanOkResp, true, false, "", "", "", "", false},
+		{"SCAN /tmp/clean.txt\t[+]0.0", false, false, "/tmp/clean.txt", "", "+", "", false},
+		{"SCAN /tmp/eicar.com\t[L]0.0\t0 EICAR Test-NOT virus!!!", false, false, "/tmp/eicar.com", "", "L", "EICAR Test-NOT virus!!!", true},
+		{"SCAN /tmp/eicar.zip|>eicar.com\t[L]1.0\t0 EICAR Test-NOT virus!!!", false, false, "/tmp/eicar.zip", ">eicar.com", "L", "EICAR Test-NOT virus!!!", true},
+		{"SCAN /tmp/a.zip|>b.tar|>c.com\t[L]2.0\t0 EICAR Test-NOT virus!!!", false, false, "/tmp/a.zip", ">b.tar|>c.com", "L", "EICAR Test-NOT virus!!!", true},
+		{"SCAN /tmp/locked.zip\t[E]0.0\tError 42110 Archive is password protected", false, false, "/tmp/locked.zip", "", "E", "Error 42110 Archive is password protected", false},
+		{"SCAN /tmp/garbage", false, true, "", "", "", "", false},
+		{"210 SCAN DATA", false, true, "", "", "", "", false},
+		{scanOkResp + "\r", true, false, "", "", "", "", false},
+		{"SCAN /tmp/eicar.com\t[L]0.0\t0 EICAR Test-\rNOT virus!!!\r", false, false, "/tmp/eicar.com", "", "L", "EICAR Test-NOT virus!!!", true},
+		{"SCAN /tmp/ei\rcar.com\r\t[+]0.0\r", false, false, "/tmp/eicar.com", "", "+", "", false},
+	}
+	for _, tt := range tests {
+		r, done, e := ParseResponseLine(tt.in)
+		if done != tt.done {
+			t.Errorf("ParseResponseLine(%q) done = %t, want %t", tt.in, done, tt.done)
+		}
+		if tt.err {
+			if e == nil {
+				t.Errorf("ParseResponseLine(%q) should return an error", tt.in)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("ParseResponseLine(%q) returned error: %s", tt.in, e)
+			continue
+		}
+		if tt.done {
+			if r != nil {
+				t.Errorf("ParseResponseLine(%q) = %v, want nil", tt.in, r)
+			}
+			continue
+		}
+		if r.Filename != tt.filename {
+			t.Errorf("ParseResponseLine(%q).Filename = %q, want %q", tt.in, r.Filename, tt.filename)
+		}
+		if r.ArchiveItem != tt.item {
+			t.Errorf("ParseResponseLine(%q).ArchiveItem = %q, want %q", tt.in, r.ArchiveItem, tt.item)
+		}
+		if r.Status != tt.status {
+			t.Errorf("ParseResponseLine(%q).Status = %q, want %q", tt.in, r.Status, tt.status)
+		}
+		if st, _ := ParseScanStatus(tt.status); r.ScanStatus != st {
+			t.Errorf("ParseResponseLine(%q).ScanStatus = %s, want %s", tt.in, r.ScanStatus, st)
+		}
+		if r.Signature != tt.signature {
+			t.Errorf("ParseResponseLine(%q).Signature = %q, want %q", tt.in, r.Signature, tt.signature)
+		}
+		if r.Infected != tt.infected {
+			t.Errorf("ParseResponseLine(%q).Infected = %t, want %t", tt.in, r.Infected, tt.infected)
+		}
+		if r.Raw != tt.in {
+			t.Errorf("ParseResponseLine(%q).Raw = %q, want %q", tt.in, r.Raw, tt.in)
+		}
+		if r.Command != Scan {
+			t.Errorf("ParseResponseLine(%q).Command = %q, want %q", tt.in, r.Command, Scan)
+		}
+	}
+}
+
+func TestArchivePath(t *testing.T) {
+	tests := []struct {
+		in   string
+		path []string
+		item string
+	}{
+		{"SCAN /tmp/clean|odd.txt\t[+]0.0", []string{"/tmp/clean|odd.txt"}, ""},
+		{"SCAN /tmp/eicar.zip|>eicar.com\t[L]1.0\t0 EICAR Test-NOT virus!!!", []string{"/tmp/eicar.zip", "eicar.com"}, ">eicar.com"},
+		{"SCAN /tmp/a|>b.zip|>c.com\t[+]1.0", []string{"/tmp/a|>b.zip", "c.com"}, ">c.com"},
+		{"SCAN /tmp/a.zip|>b.tar|>c.com\t[L]2.0\t0 EICAR Test-NOT virus!!!", []string{"/tmp/a.zip", "b.tar", "c.com"}, ">b.tar|>c.com"},
+		{"SCAN /tmp/x|y.zip|>b.tar|>c|d.com\t[+]2.0", []string{"/tmp/x|y.zip", "b.tar", "c|d.com"}, ">b.tar|>c|d.com"},
+	}
+	for _, tt := range tests {
+		r, _, e := ParseResponseLine(tt.in)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if strings.Join(r.ArchivePath, "\n") != strings.Join(tt.path, "\n") {
+			t.Errorf("ParseResponseLine(%q).ArchivePath = %q, want %q", tt.in, r.ArchivePath, tt.path)
+		}
+		if r.Filename != tt.path[0] || r.ArchiveItem != tt.item {
+			t.Errorf("ParseResponseLine(%q) = %q, %q, want %q, %q", tt.in, r.Filename, r.ArchiveItem, tt.path[0], tt.item)
+		}
+	}
+}
+
+func TestScanLimiter(t *testing.T) {
+	if l := NewScanLimiter(0); l.Cap() != 1 {
+		t.Errorf("NewScanLimiter(0).Cap() = %d, want %d", l.Cap(), 1)
+	}
+	l := NewScanLimiter(1)
+	release, e := l.acquire(context.Background())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, e = l.acquire(ctx); e != context.DeadlineExceeded {
+		t.Errorf("l.acquire() on a full limiter = %v, want %v", e, context.DeadlineExceeded)
+	}
+	release()
+	if release, e = l.acquire(context.Background()); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	release()
+
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"210 VPS DATA", "VPS 19052406", "200 VPS OK"}
+	})
+	p, e := NewPool(context.Background(), address, 3, WithMaxConcurrentScans(2))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer p.Close()
+	for _, c := range p.all {
+		if c.limiter != p.all[0].limiter || c.limiter.Cap() != 2 {
+			t.Errorf("the pool clients should share a limiter of %d", 2)
+		}
+	}
+	c1, e := NewClient(context.Background(), address, time.Second, time.Second, WithMaxConcurrentScans(5))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c1.Close()
+	if c1.limiter == p.all[0].limiter || c1.limiter.Cap() != 5 {
+		t.Errorf("WithMaxConcurrentScans(5) should create its own limiter")
+	}
+	shared := NewScanLimiter(4)
+	c2, e := NewClient(context.Background(), address, time.Second, time.Second, WithScanLimiter(shared))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c2.Close()
+	if c2.limiter != shared {
+		t.Errorf("WithScanLimiter() should use the passed limiter")
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	e := &CommandError{Command: "SCAN /tmp/x", Err: ErrPathNotAllowed}
+	expected := "SCAN /tmp/x: " + ErrPathNotAllowed.Error()
+	if e.Error() != expected {
+		t.Errorf("Got %q want %q", e.Error(), expected)
+	}
+	if !errors.Is(e, ErrPathNotAllowed) {
+		t.Errorf("errors.Is(%v, ErrPathNotAllowed) should be true", e)
+	}
+	e.Client = "daemon1"
+	expected = "daemon1: " + expected
+	if e.Error() != expected {
+		t.Errorf("Got %q want %q", e.Error(), expected)
+	}
+}
+
+func TestCloseFailedClient(t *testing.T) {
+	var c *Client
+	if e := c.Close(); e != nil {
+		t.Errorf("Close() on a nil client = %v, want nil", e)
+	}
+	c = &Client{}
+	if e := c.Close(); e != nil {
+		t.Errorf("Close() on an unconnected client = %v, want nil", e)
+	}
+
+	address := t.TempDir() + "/avast.sock"
+	l, e := net.Listen("unix", address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer l.Close()
+	go func() {
+		conn, e := l.Accept()
+		if e == nil {
+			conn.Close()
+		}
+	}()
+	ctx := context.Background()
+	c, e = NewClient(ctx, address, time.Second, time.Second)
+	if e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	if e = c.Close(); e != nil {
+		t.Errorf("Close() after a failed greeting = %v, want nil", e)
+	}
+}
+
+func TestNewScanReport(t *testing.T) {
+	r := []*Response{
+		{Filename: "/tmp/a", Signature: "EICAR Test-NOT virus!!!", Infected: true},
+		{Filename: "/tmp/b", Signature: "Win32:Trojan-gen", Infected: true},
+		{Filename: "/tmp/c", Signature: "Win32:Trojan-XY [Trj]", Infected: true},
+		{Filename: "/tmp/d", Signature: "", Infected: true},
+		{Filename: "/tmp/e", Status: "+"},
+	}
+	rp := NewScanReport(r, nil)
+	expected := map[string]int{"EICAR": 1, "Win32:Trojan": 2, unknownCategory: 1}
+	if len(rp.CategoryCounts) != len(expected) {
+		t.Errorf("NewScanReport().CategoryCounts = %v, want %v", rp.CategoryCounts, expected)
+	}
+	for k, v := range expected {
+		if rp.CategoryCounts[k] != v {
+			t.Errorf("NewScanReport().CategoryCounts[%q] = %d, want %d", k, rp.CategoryCounts[k], v)
+		}
+	}
+	if rp.Files != 5 || rp.InfectedFiles != 4 || rp.ArchiveMembers != 0 || rp.InfectedMembers != 0 {
+		t.Errorf("NewScanReport() counts = %d/%d files %d/%d members", rp.InfectedFiles, rp.Files, rp.InfectedMembers, rp.ArchiveMembers)
+	}
+	rp = NewScanReport(append(r, &Response{Filename: "/tmp/f.zip", ArchiveItem: "g", Infected: true}, &Response{Filename: "/tmp/f.zip", ArchiveItem: "h"}), nil)
+	if rp.ArchiveMembers != 2 || rp.InfectedMembers != 1 {
+		t.Errorf("NewScanReport() counts = %d/%d members, want 1/2", rp.InfectedMembers, rp.ArchiveMembers)
+	}
+	if ratio := rp.InfectionRatio(); ratio != 5.0/7.0 {
+		t.Errorf("rp.InfectionRatio() = %f, want %f", ratio, 5.0/7.0)
+	}
+	if ratio := (&ScanReport{}).InfectionRatio(); ratio != 0 {
+		t.Errorf("InfectionRatio() of an empty report = %f, want 0", ratio)
+	}
+	rp = NewScanReport(r, func(string) string { return "all" })
+	if rp.CategoryCounts["all"] != 4 {
+		t.Errorf("NewScanReport().CategoryCounts[%q] = %d, want %d", "all", rp.CategoryCounts["all"], 4)
+	}
+}
+
+func TestStateTokens(t *testing.T) {
+	cur := " +mime -zip +rar"
+	want := []optionState{
+		{"mime", true},
+		{"zip", true},
+		{"rar", false},
+		{"tar", true},
+	}
+	expected := []string{"+zip", "-rar", "+tar"}
+	got := stateTokens(cur, want)
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("stateTokens(%q) = %q, want %q", cur, got, expected)
+	}
+	if got = stateTokens(cur, want[:1]); len(got) != 0 {
+		t.Errorf("stateTokens(%q) = %q, want none", cur, got)
+	}
+}
+
+func TestBuildCommands(t *testing.T) {
+	l, e := BuildPackCommand(map[PackOption]bool{Zip: false, Mime: true, Dmg: true})
+	if e != nil || l != "PACK +mime -zip +dmg" {
+		t.Errorf("BuildPackCommand() = %q, %v, want %q", l, e, "PACK +mime -zip +dmg")
+	}
+	l, e = BuildFlagsCommand(map[Flag]bool{ScanDevices: false, FullFiles: true})
+	if e != nil || l != "FLAGS +fullfiles -scandevices" {
+		t.Errorf("BuildFlagsCommand() = %q, %v, want %q", l, e, "FLAGS +fullfiles -scandevices")
+	}
+	l, e = BuildSensitivityCommand(map[SensiOption]bool{Pup: true, Worm: false})
+	if e != nil || l != "SENSITIVITY -worm +pup" {
+		t.Errorf("BuildSensitivityCommand() = %q, %v, want %q", l, e, "SENSITIVITY -worm +pup")
+	}
+	if l, e = BuildPackCommand(nil); e != nil || l != "" {
+		t.Errorf("BuildPackCommand(nil) = %q, %v, want an empty line", l, e)
+	}
+	if l, e = BuildFlagsCommand(map[Flag]bool{Flag(99): true}); e == nil || l != "" {
+		t.Errorf("BuildFlagsCommand() = %q, %v, want an error", l, e)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	ctx := context.Background()
+	_, e := NewClient(ctx, "127.0.0.1:1", time.Second, time.Second, WithNetwork("udp"))
+	if e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	expected := fmt.Sprintf(unsupportedNetErr, "udp")
+	if e.Error() != expected {
+		t.Errorf("Got %q want %q", e, expected)
+	}
+
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer l.Close()
+	go func() {
+		conn, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "220 DAEMON\r\n")
+	}()
+	c, e := NewClient(ctx, l.Addr().String(), time.Second, time.Second, WithNetwork("tcp"))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.tc.Close()
+}
+
+func TestWaitForSocket(t *testing.T) {
+	address := t.TempDir() + "/avast.sock"
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if e := WaitForSocket(ctx, address); e != context.DeadlineExceeded {
+		t.Errorf("WaitForSocket(%q) = %v, want %v", address, e, context.DeadlineExceeded)
+	}
+
+	ready := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		l, e := net.Listen("unix", address)
+		if e != nil {
+			ready <- nil
+			return
+		}
+		ready <- l
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if e := WaitForSocket(ctx, address); e != nil {
+		t.Errorf("WaitForSocket(%q) = %v, want nil", address, e)
+	}
+	if l := <-ready; l != nil {
+		l.Close()
+	}
+}
+
+func TestParsePackOptionNames(t *testing.T) {
+	for _, tt := range TestPackOptions {
+		p, e := ParsePackOption(tt.out)
+		if tt.out == "" {
+			if e == nil {
+				t.Errorf("ParsePackOption(%q) should return an error", tt.out)
+			}
+			continue
+		}
+		if e != nil || p != tt.in {
+			t.Errorf("ParsePackOption(%q) = %d, %v, want %d", tt.out, p, e, tt.in)
+		}
+	}
+}
+
+// fakeServer starts an avasttest server replying with handler
+// that is closed when the test finishes
+func fakeServer(t *testing.T, handler avasttest.ConnHandler) (address string) {
+	s, e := avasttest.NewConnServer(handler)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	t.Cleanup(func() { s.Close() })
+	address = s.Address
+	return
+}
+
+func TestScanRetryOnParseError(t *testing.T) {
+	handler := func(n int, l string) []string {
+		if n == 0 {
+			return []string{"210 SCAN DATA", "SCAN garbage", scanOkResp}
+		}
+		return []string{"210 SCAN DATA", "SCAN /tmp/clean.txt\t[+]0.0", scanOkResp}
+	}
+	address := fakeServer(t, handler)
+	ctx := context.Background()
+	c, e := NewClient(ctx, address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if _, e = c.Scan("/tmp/clean.txt"); e == nil {
+		t.Fatalf("An error should be returned")
+	}
+
+	address = fakeServer(t, handler)
+	c, e = NewClient(ctx, address, time.Second, time.Second, WithScanRetryOnParseError(1))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.Scan("/tmp/clean.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Filename != "/tmp/clean.txt" {
+		t.Errorf("c.Scan() = %v, want a single result", r)
+	}
+
+	var dials int32
+	address = fakeServer(t, func(n int, l string) []string {
+		return []string{"210 SCAN DATA", "SCAN garbage", scanOkResp}
+	})
+	dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return net.Dial(network, address)
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	c, e = NewClient(ctx, address, 5*time.Second, time.Second, WithDialer(dialer), WithScanRetryOnParseError(1))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	sctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, e = c.ScanContext(sctx, "/tmp/clean.txt"); !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("c.ScanContext() with a stalled reconnect = %v, want %v", e, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the reconnect took %s, want it to stop at the deadline", d)
+	}
+}
+
+func TestCheckURLContext(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if l == "CHECKURL http://www.example.com/fast" {
+			return []string{"200 OK"}
+		}
+		return nil
+	})
+	c, e := NewClient(context.Background(), address, time.Second, 10*time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.tc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	b, e := c.CheckURLContext(ctx, "http://www.example.com/fast")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if b {
+		t.Errorf("c.CheckURLContext() = %t, want %t", b, false)
+	}
+	start := time.Now()
+	if _, e = c.CheckURLContext(ctx, "http://www.example.com/slow"); !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("c.CheckURLContext() = %v, want %v", e, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("c.CheckURLContext() took %s, should honor the context deadline", d)
+	}
+}
+
+func TestAbsFilenames(t *testing.T) {
+	wd, e := os.Getwd()
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	r := []*Response{
+		{Filename: "/var/spool/a.txt"},
+		{Filename: "testdata/b.txt"},
+		{Filename: "c.txt", ArchiveItem: "inner/d.txt"},
+	}
+	absFilenames("testdata", r)
+	expected := []string{
+		"/var/spool/a.txt",
+		wd + "/testdata/b.txt",
+		wd + "/testdata/c.txt",
+	}
+	for i, rs := range r {
+		if rs.Filename != expected[i] {
+			t.Errorf("absFilenames() = %q, want %q", rs.Filename, expected[i])
+		}
+	}
+	if r[2].ArchiveItem != "inner/d.txt" {
+		t.Errorf("absFilenames() should not change archive items")
+	}
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Sensitivity.String()) {
+			return []string{"500 Unknown command"}
+		}
+		return []string{"210 FLAGS DATA", "FLAGS +fullfiles", "200 FLAGS OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	_, e = c.GetSensitivity()
+	if !errors.Is(e, ErrUnsupportedCommand) {
+		t.Fatalf("c.GetSensitivity() = %v, want %v", e, ErrUnsupportedCommand)
+	}
+	var ue *UnsupportedCommandError
+	if !errors.As(e, &ue) || ue.Command != Sensitivity {
+		t.Errorf("c.GetSensitivity() = %v, want an UnsupportedCommandError for %s", e, Sensitivity)
+	}
+	if e = c.SetSensitivity(Worm, true); !errors.Is(e, ErrUnsupportedCommand) {
+		t.Errorf("c.SetSensitivity() = %v, want %v", e, ErrUnsupportedCommand)
+	}
+	f, e := c.GetFlags()
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if f != " +fullfiles" {
+		t.Errorf("c.GetFlags() = %q, want %q", f, " +fullfiles")
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Flags.String()) {
+			return []string{"451 Engine error"}
+		}
+		if strings.HasPrefix(l, Scan.String()) {
+			return []string{"520 Scan failed"}
+		}
+		return []string{"210 PACK DATA", "garbage", "200 PACK OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	var re *ResponseError
+	if _, e = c.GetFlags(); !errors.As(e, &re) {
+		t.Fatalf("c.GetFlags() = %v, want a ResponseError", e)
+	}
+	if re.Code != 451 || re.Command != Flags || re.Line != "Engine error" {
+		t.Errorf("c.GetFlags() = %+v, want code 451 for %s", re, Flags)
+	}
+	if _, e = c.Scan("/tmp"); !errors.As(e, &re) || re.Code != 520 || re.Command != Scan {
+		t.Errorf("c.Scan() = %v, want a ResponseError with code 520", e)
+	}
+	if _, e = c.GetPack(); !errors.As(e, &re) || re.Code != 0 || re.Line != "garbage" {
+		t.Errorf("c.GetPack() = %v, want an invalid response error", e)
+	}
+}
+
+func TestResponseErrorSentinels(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			return []string{"451 Engine error: Permission denied"}
+		}
+		return []string{"451 Engine error: License expired"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if _, e = c.Vps(); !errors.Is(e, ErrLicenseExpired) || errors.Is(e, ErrPermissionDenied) {
+		t.Errorf("c.Vps() = %v, want %v", e, ErrLicenseExpired)
+	}
+	if _, e = c.Scan("/tmp/clean.txt"); !errors.Is(e, ErrPermissionDenied) || errors.Is(e, ErrLicenseExpired) {
+		t.Errorf("c.Scan() = %v, want %v", e, ErrPermissionDenied)
+	}
+	if errors.Is(&ResponseError{Command: Vps, Line: "license"}, ErrLicenseExpired) {
+		t.Errorf("an unparsed response should not match %v", ErrLicenseExpired)
+	}
+}
+
+func TestOpeningErrorNoSuchPath(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"550 Path not found"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	_, e = c.Scan("/tmp/missing")
+	if !errors.Is(e, ErrNoSuchPath) {
+		t.Errorf("c.Scan() = %v, want %v", e, ErrNoSuchPath)
+	}
+	var re *ResponseError
+	if !errors.As(e, &re) || re.Arg != "/tmp/missing" || re.Code != 550 {
+		t.Errorf("c.Scan() = %v, want a ResponseError for %q", e, "/tmp/missing")
+	}
+	if !strings.Contains(e.Error(), "SCAN /tmp/missing") {
+		t.Errorf("e.Error() = %q, want it to name the command and path", e.Error())
+	}
+}
+
+func TestPoolScanFilesOrdered(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		p := strings.TrimPrefix(l, Scan.String()+" ")
+		if p == "/tmp/missing" {
+			return []string{"210 SCAN DATA", "SCAN broken", scanOkResp}
+		}
+		time.Sleep(time.Duration(len(p)) * time.Millisecond)
+		return []string{"210 SCAN DATA", "SCAN " + p + "\t[+]0.0", scanOkResp}
+	})
+	if _, e := NewPool(context.Background(), address, 0); e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	p, e := NewPool(context.Background(), address, 3)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer p.Close()
+	paths := []string{"/tmp/a-long-name", "/tmp/b", "/tmp/missing", "/tmp/c-medium", "/tmp/d"}
+	r, e := p.ScanFilesOrdered(context.Background(), paths)
+	if e == nil {
+		t.Errorf("An error should be returned for %q", "/tmp/missing")
+	}
+	if len(r) != len(paths) {
+		t.Fatalf("p.ScanFilesOrdered() returned %d results, want %d", len(r), len(paths))
+	}
+	for i, fn := range paths {
+		if fn == "/tmp/missing" {
+			continue
+		}
+		if len(r[i]) != 1 || r[i][0].Filename != fn {
+			t.Errorf("p.ScanFilesOrdered()[%d] = %v, want result for %q", i, r[i], fn)
+		}
+	}
+}
+
+func TestPoolScanCheckURL(t *testing.T) {
+	release := make(chan struct{})
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, CheckURL.String()) {
+			if strings.HasSuffix(l, "/slow") {
+				<-release
+			}
+			return []string{"520 " + strings.TrimPrefix(l, CheckURL.String()+" ") + "\t" + urlBlockedResp}
+		}
+		p := strings.TrimPrefix(l, Scan.String()+" ")
+		return []string{"210 SCAN DATA", "SCAN " + p + "\t[L]0.0\tEICAR Test-NOT virus!!!", scanOkResp}
+	})
+	p, e := NewPool(context.Background(), address, 1)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer p.Close()
+	r, e := p.Scan("/tmp/eicar.com")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || !r[0].Infected {
+		t.Errorf("p.Scan() = %v, want an infected result", r)
+	}
+	if s := p.Stats(); s.Idle != 1 || s.InUse != 0 {
+		t.Errorf("p.Stats() = %+v, want 1 idle", s)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if b, e := p.CheckURL("http://www.example.com/slow"); e != nil || !b {
+			t.Errorf("p.CheckURL() = %t, %v, want blocked", b, e)
+		}
+	}()
+	for p.Stats().InUse != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, e = p.CheckURLContext(ctx, "http://www.example.com/"); !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("p.CheckURLContext() = %v, want %v with the pool exhausted", e, context.DeadlineExceeded)
+	}
+	close(release)
+	<-done
+	if s := p.Stats(); s.Idle != 1 || s.InUse != 0 {
+		t.Errorf("p.Stats() = %+v, want 1 idle", s)
+	}
+}
+
+func TestCaptureFraming(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			return []string{"210 SCAN DATA", "SCAN /tmp/clean.txt\t[+]0.0", scanOkResp}
+		}
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithCaptureFraming())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if _, e = c.Vps(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	expected := Framing{Open: "210 VPS DATA", Close: "200 VPS OK"}
+	if f := c.LastFraming(); f != expected {
+		t.Errorf("c.LastFraming() = %v, want %v", f, expected)
+	}
+	if _, e = c.Scan("/tmp/clean.txt"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	expected = Framing{Open: "210 SCAN DATA", Close: scanOkResp}
+	if f := c.LastFraming(); f != expected {
+		t.Errorf("c.LastFraming() = %v, want %v", f, expected)
+	}
+}
+
+func TestScanNamed(t *testing.T) {
+	var scanned string
+	address := fakeServer(t, func(n int, l string) []string {
+		scanned = strings.TrimPrefix(l, Scan.String()+" ")
+		return []string{
+			"210 SCAN DATA",
+			"SCAN " + scanned + "\t[L]0.0\t0 EICAR Test-NOT virus!!!",
+			"SCAN " + scanned + "|>eicar.com\t[L]1.0\t0 EICAR Test-NOT virus!!!",
+			scanOkResp,
+		}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.ScanNamed("upload.com", strings.NewReader("X5O!P%@AP"))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 2 {
+		t.Fatalf("c.ScanNamed() = %v, want %d results", r, 2)
+	}
+	for _, rs := range r {
+		if rs.Filename != "upload.com" || rs.RawFilename != "upload.com" || rs.Path != "upload.com" ||
+			rs.ArchivePath[0] != "upload.com" || strings.Contains(rs.Raw, scanned) {
+			t.Errorf("c.ScanNamed() = %+v, want every path field labeled %q", rs, "upload.com")
+		}
+	}
+	if r[1].ArchivePath[1] != "eicar.com" {
+		t.Errorf("c.ScanNamed() archive member = %q, want %q", r[1].ArchivePath, "eicar.com")
+	}
+	if _, e = os.Stat(scanned); !os.IsNotExist(e) {
+		t.Errorf("The temporary file %q should be removed", scanned)
+	}
+}
+
+func TestEncodeDecodeOptions(t *testing.T) {
+	p, e := DecodePackOptions("zip, rar,,7zip")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if s := EncodePackOptions(p); s != "zip,rar,7zip" {
+		t.Errorf("EncodePackOptions(%v) = %q, want %q", p, s, "zip,rar,7zip")
+	}
+	if _, e = DecodePackOptions("zip,bogus"); e == nil || e.Error() != fmt.Sprintf(unknownOptionErr, "bogus") {
+		t.Errorf("DecodePackOptions() = %v, want %q", e, fmt.Sprintf(unknownOptionErr, "bogus"))
+	}
+	f, e := DecodeFlags("fullfiles,scandevices")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if s := EncodeFlags(f); s != "fullfiles,scandevices" {
+		t.Errorf("EncodeFlags(%v) = %q, want %q", f, s, "fullfiles,scandevices")
+	}
+	if _, e = DecodeFlags("zip"); e == nil {
+		t.Errorf("DecodeFlags(%q) should return an error", "zip")
+	}
+	so, e := DecodeSensiOptions("worm,trojan,pube")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if s := EncodeSensiOptions(so); s != "worm,trojan,pube" {
+		t.Errorf("EncodeSensiOptions(%v) = %q, want %q", so, s, "worm,trojan,pube")
+	}
+	if o, e := DecodeSensiOptions(""); e != nil || len(o) != 0 {
+		t.Errorf("DecodeSensiOptions(%q) = %v, %v, want empty", "", o, e)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	if p, e := ParsePackOption("BZip2"); e != nil || p != Bzip2 {
+		t.Errorf("ParsePackOption(%q) = %v, %v, want %v", "BZip2", p, e, Bzip2)
+	}
+	if p, e := ParsePackOption("7zip"); e != nil || p != Szip {
+		t.Errorf("ParsePackOption(%q) = %v, %v, want %v", "7zip", p, e, Szip)
+	}
+	if _, e := ParsePackOption("bogus"); e == nil || e.Error() != fmt.Sprintf(unknownOptionErr, "bogus") {
+		t.Errorf("ParsePackOption() = %v, want %q", e, fmt.Sprintf(unknownOptionErr, "bogus"))
+	}
+	if f, e := ParseFlag("ScanDevices"); e != nil || f != ScanDevices {
+		t.Errorf("ParseFlag(%q) = %v, %v, want %v", "ScanDevices", f, e, ScanDevices)
+	}
+	if _, e := ParseFlag("zip"); e == nil {
+		t.Errorf("ParseFlag(%q) should return an error", "zip")
+	}
+	if so, e := ParseSensiOption("PUBE"); e != nil || so != Pube {
+		t.Errorf("ParseSensiOption(%q) = %v, %v, want %v", "PUBE", so, e, Pube)
+	}
+	if _, e := ParseSensiOption(""); e == nil {
+		t.Errorf("ParseSensiOption(%q) should return an error", "")
+	}
+	var p PackOption
+	if e := p.Set(" ZIP "); e != nil || p != Zip {
+		t.Errorf("p.Set(%q) = %v, %v, want %v", " ZIP ", p, e, Zip)
+	}
+	var f Flag
+	if e := f.Set("AllFiles"); e != nil || f != AllFiles {
+		t.Errorf("f.Set(%q) = %v, %v, want %v", "AllFiles", f, e, AllFiles)
+	}
+	if o, e := DecodePackOptions("Zip,RAR"); e != nil || len(o) != 2 || o[0] != Zip || o[1] != Rar {
+		t.Errorf("DecodePackOptions(%q) = %v, %v, want %v", "Zip,RAR", o, e, []PackOption{Zip, Rar})
+	}
+	if o, e := DecodeSensiOptions("WORM"); e != nil || len(o) != 1 || o[0] != Worm {
+		t.Errorf("DecodeSensiOptions(%q) = %v, %v, want %v", "WORM", o, e, []SensiOption{Worm})
+	}
+}
+
+func TestAllOptions(t *testing.T) {
+	p := AllPackOptions()
+	if len(p) != int(Dmg) || p[0] != Mime || p[len(p)-1] != Dmg {
+		t.Errorf("AllPackOptions() = %v, want %s to %s", p, Mime, Dmg)
+	}
+	f := AllFlags()
+	if len(f) != int(ScanDevices) || f[0] != FullFiles || f[len(f)-1] != ScanDevices {
+		t.Errorf("AllFlags() = %v, want %s to %s", f, FullFiles, ScanDevices)
+	}
+	so := AllSensiOptions()
+	if len(so) != int(Pube) || so[0] != Worm || so[len(so)-1] != Pube {
+		t.Errorf("AllSensiOptions() = %v, want %s to %s", so, Worm, Pube)
+	}
+	for _, o := range so {
+		if o.String() == "" {
+			t.Errorf("AllSensiOptions() includes %d without a name", int(o))
+		}
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	type config struct {
+		Packers     []PackOption
+		Flag        Flag
+		Sensitivity map[SensiOption]bool
+	}
+	in := config{
+		Packers:     []PackOption{Bzip2, Szip},
+		Flag:        ScanDevices,
+		Sensitivity: map[SensiOption]bool{Pube: true},
+	}
+	b, e := json.Marshal(in)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	want := `{"Packers":["bzip2","7zip"],"Flag":"scandevices","Sensitivity":{"pube":true}}`
+	if string(b) != want {
+		t.Errorf("json.Marshal() = %s, want %s", b, want)
+	}
+	var out config
+	if e = json.Unmarshal(b, &out); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(out.Packers) != 2 || out.Packers[0] != Bzip2 || out.Packers[1] != Szip || out.Flag != ScanDevices || !out.Sensitivity[Pube] {
+		t.Errorf("json.Unmarshal() = %+v, want %+v", out, in)
+	}
+	if e = json.Unmarshal([]byte(`{"Flag":"bogus"}`), &out); e == nil || !strings.Contains(e.Error(), fmt.Sprintf(unknownOptionErr, "bogus")) {
+		t.Errorf("json.Unmarshal() = %v, want %q", e, fmt.Sprintf(unknownOptionErr, "bogus"))
+	}
+	if _, e = json.Marshal(PackOption(0)); e == nil {
+		t.Errorf("json.Marshal(PackOption(0)) should return an error")
+	}
+}
+
+func TestPflagValues(t *testing.T) {
+	var p PackOption
+	var f Flag
+	var so SensiOption
+	var pl PackOptionList
+	var fl FlagList
+	var sl SensiOptionList
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&p, "packer", "")
+	fs.Var(&f, "flag", "")
+	fs.Var(&so, "sensi", "")
+	fs.Var(&pl, "pack", "")
+	fs.Var(&fl, "flags", "")
+	fs.Var(&sl, "sensitivity", "")
+	e := fs.Parse([]string{
+		"--packer", "7zip",
+		"--flag", "allfiles",
+		"--sensi", "rootkit",
+		"--pack", "zip,rar",
+		"--pack", "tar",
+		"--flags", "fullfiles",
+		"--sensitivity", "worm,trojan",
+	})
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if p != Szip || f != AllFiles || so != Rootkit {
+		t.Errorf("Got %q, %q, %q want %q, %q, %q", p, f, so, Szip, AllFiles, Rootkit)
+	}
+	if s := pl.String(); s != "zip,rar,tar" {
+		t.Errorf("pl.String() = %q, want %q", s, "zip,rar,tar")
+	}
+	if s := fl.String(); s != "fullfiles" {
+		t.Errorf("fl.String() = %q, want %q", s, "fullfiles")
+	}
+	if s := sl.String(); s != "worm,trojan" {
+		t.Errorf("sl.String() = %q, want %q", s, "worm,trojan")
+	}
+	for _, v := range []flag.Value{&p, &f, &so, &pl, &fl, &sl} {
+		if e = v.Set("bogus"); e == nil {
+			t.Errorf("%s.Set(%q) should return an error", v.Type(), "bogus")
+		}
+	}
+	if p != Szip {
+		t.Errorf("A failed Set should not change the value, got %q", p)
+	}
+}
+
+func TestFormatSyslog(t *testing.T) {
+	ts := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, ok := formatSyslog(&Response{Filename: "/tmp/a", Status: "+"}, ts, "host", "avast@99999"); ok {
+		t.Errorf("formatSyslog() should skip clean results")
+	}
+	rs := &Response{Filename: `/tmp/"b"`, Status: "L", Signature: "EICAR Test-NOT virus!!!", Infected: true}
+	m, ok := formatSyslog(rs, ts, "host", "avast@99999")
+	if !ok {
+		t.Fatalf("formatSyslog() should log infected results")
+	}
+	prefix := `<10>1 2021-01-02T03:04:05Z host avast `
+	if !strings.HasPrefix(m, prefix) {
+		t.Errorf("formatSyslog() = %q, should start with %q", m, prefix)
+	}
+	sd := `[avast@99999 file="/tmp/\"b\"" item="" status="infected" signature="EICAR Test-NOT virus!!!"]`
+	if !strings.Contains(m, sd) {
+		t.Errorf("formatSyslog() = %q, should contain %q", m, sd)
+	}
+	m, _ = formatSyslog(rs, ts, "host", "")
+	if !strings.Contains(m, " - infected: ") || strings.Contains(m, "[") {
+		t.Errorf("formatSyslog() = %q, should not carry structured data without an SD-ID", m)
+	}
+	m, ok = formatSyslog(&Response{Filename: "/tmp/c", Status: "E"}, ts, "host", "avast@99999")
+	if !ok || !strings.HasPrefix(m, "<12>1 ") {
+		t.Errorf("formatSyslog() = %q, should log errors as warnings", m)
+	}
+}
+
+func TestQuarantineScan(t *testing.T) {
+	dir := t.TempDir()
+	qdir := t.TempDir() + "/quarantine"
+	infected := dir + "/eicar.com"
+	clean := dir + "/clean.txt"
+	for _, fn := range []string{infected, clean} {
+		if e := os.WriteFile(fn, []byte("data"), 0644); e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+	}
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{
+			"210 SCAN DATA",
+			"SCAN " + clean + "\t[+]0.0",
+			"SCAN " + infected + "\t[L]0.0\t0 EICAR Test-NOT virus!!!",
+			"SCAN " + dir + "/missing.com\t[L]0.0\t0 EICAR Test-NOT virus!!!",
+			"SCAN " + dir + "/eicar.zip|>eicar.com\t[L]1.0\t0 EICAR Test-NOT virus!!!",
+			scanOkResp,
+		}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	rp, e := c.QuarantineScan(dir, qdir)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(rp.Quarantined) != 1 || rp.Quarantined[0].Original != infected {
+		t.Fatalf("c.QuarantineScan() quarantined %v, want %q", rp.Quarantined, infected)
+	}
+	if _, e = os.Stat(infected); !os.IsNotExist(e) {
+		t.Errorf("%q should be moved to quarantine", infected)
+	}
+	if _, e = os.Stat(rp.Quarantined[0].Quarantined); e != nil {
+		t.Errorf("%q should exist: %s", rp.Quarantined[0].Quarantined, e)
+	}
+	if _, e = os.Stat(clean); e != nil {
+		t.Errorf("%q should not be moved: %s", clean, e)
+	}
+	if _, ok := rp.Failed[dir+"/missing.com"]; !ok || len(rp.Failed) != 1 {
+		t.Errorf("c.QuarantineScan() failed %v, want %q", rp.Failed, dir+"/missing.com")
+	}
+	m, e := os.ReadFile(qdir + "/" + QuarantineManifest)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !strings.Contains(string(m), `"original":"`+infected+`"`) {
+		t.Errorf("The manifest %q should record %q", m, infected)
+	}
+}
+
+func TestConnectBackoff(t *testing.T) {
+	address := t.TempDir() + "/avast.sock"
+	ready := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l, e := net.Listen("unix", address)
+		if e != nil {
+			ready <- nil
+			return
+		}
+		ready <- l
+		conn, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "220 DAEMON\r\n")
+		time.Sleep(100 * time.Millisecond)
+	}()
+	ctx := context.Background()
+	if _, e := NewClient(ctx, address, time.Second, time.Second); e == nil {
+		t.Fatalf("An error should be returned without backoff")
+	}
+	c, e := NewClient(ctx, address, time.Second, time.Second, WithConnectBackoff(10, 20*time.Millisecond, 50*time.Millisecond))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.tc.Close()
+	if l := <-ready; l != nil {
+		l.Close()
+	}
+
+	missing := t.TempDir() + "/missing.sock"
+	_, e = NewClient(ctx, missing, time.Second, time.Second, WithConnectBackoff(2, time.Millisecond, time.Millisecond))
+	if e == nil || e.Error() != fmt.Sprintf(unixSockErr, missing) {
+		t.Errorf("Got %v want %q", e, fmt.Sprintf(unixSockErr, missing))
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"210 SCAN DATA", "SCAN broken", scanOkResp}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithTranscript(1024))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	_, e = c.Scan("/tmp/x")
+	var ce *CommandError
+	if !errors.As(e, &ce) {
+		t.Fatalf("c.Scan() = %v, want a CommandError", e)
+	}
+	expected := []string{"> SCAN /tmp/x", "< 210 SCAN DATA", "< SCAN broken", "< " + scanOkResp}
+	if strings.Join(ce.Transcript, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Transcript = %q, want %q", ce.Transcript, expected)
+	}
+	if tr := c.LastTranscript(); strings.Join(tr, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("c.LastTranscript() = %q, want %q", tr, expected)
+	}
+
+	c.transcriptMax = 20
+	c.Scan("/tmp/x")
+	expected = []string{"> SCAN /tmp/x", truncatedMarker}
+	if tr := c.LastTranscript(); strings.Join(tr, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("c.LastTranscript() = %q, want %q", tr, expected)
+	}
+}
+
+func TestNewClientContextDeadline(t *testing.T) {
+	address := t.TempDir() + "/avast.sock"
+	l, e := net.Listen("unix", address)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer l.Close()
+	go func() {
+		conn, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(2 * time.Second)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, e = NewClient(ctx, address, 10*time.Second, 10*time.Second)
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("NewClient() = %v, want %v", e, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("NewClient() took %s, should honor the context deadline", d)
+	}
+}
+
+func TestSupportedArchives(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"210 PACK DATA", "PACK +mime -zip +rar +xz", "200 PACK OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, u, e := c.SupportedArchives()
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if EncodePackOptions(r) != "mime,zip,rar" {
+		t.Errorf("c.SupportedArchives() = %v, want %q", r, "mime,zip,rar")
+	}
+	if len(u) != 1 || u[0] != "xz" {
+		t.Errorf("c.SupportedArchives() unknown = %q, want %q", u, "xz")
+	}
+}
+
+func TestGetPackOptions(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"210 PACK DATA", "PACK  +mime   -zip +rar +xz", "200 PACK OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	m, e := c.GetPackOptions()
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	want := map[PackOption]bool{Mime: true, Zip: false, Rar: true}
+	if len(m) != len(want) {
+		t.Errorf("c.GetPackOptions() = %v, want %v", m, want)
+	}
+	for k, v := range want {
+		if g, ok := m[k]; !ok || g != v {
+			t.Errorf("c.GetPackOptions()[%s] = %t, want %t", k, g, v)
+		}
+	}
+}
+
+func TestGetOptionStates(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Flags.String()) {
+			return []string{"210 FLAGS DATA", "FLAGS  +fullfiles -allfiles +newflag ", "200 FLAGS OK"}
+		}
+		return []string{"210 SENSITIVITY DATA", "SENSITIVITY +worm -trojan\t+pube -future", "200 SENSITIVITY OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	f, e := c.GetFlagStates()
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(f) != 2 || !f[FullFiles] || f[AllFiles] {
+		t.Errorf("c.GetFlagStates() = %v, want fullfiles on and allfiles off", f)
+	}
+	so, e := c.GetSensitivityStates()
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(so) != 3 || !so[Worm] || so[Trojan] || !so[Pube] {
+		t.Errorf("c.GetSensitivityStates() = %v, want worm and pube on, trojan off", so)
+	}
+}
+
+func TestSetPackOptions(t *testing.T) {
+	var sent []string
+	address := fakeServer(t, func(n int, l string) []string {
+		sent = append(sent, l)
+		return []string{"210 PACK DATA", l, "200 PACK OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if e = c.SetPackOptions(map[PackOption]bool{Rar: true, Mime: false, Zip: true}); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if e = c.SetPackOptions(map[PackOption]bool{Zip: true, PackOption(99): true}); e == nil {
+		t.Errorf("c.SetPackOptions() should return an error for an invalid option")
+	}
+	if e = c.SetPackOptions(nil); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	if len(sent) != 1 || sent[0] != "PACK -mime +zip +rar" {
+		t.Errorf("c.SetPackOptions() sent %q, want %q", sent, "PACK -mime +zip +rar")
+	}
+}
+
+func TestSetOptionStates(t *testing.T) {
+	var sent []string
+	address := fakeServer(t, func(n int, l string) []string {
+		sent = append(sent, l)
+		if strings.HasPrefix(l, Sensitivity.String()+" ") && strings.Contains(l, "+pube") {
+			return []string{"501 Bad option"}
+		}
+		c := strings.Fields(l)[0]
+		return []string{"210 " + c + " DATA", l, "200 " + c + " OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if e = c.SetFlagStates(map[Flag]bool{ScanDevices: false, FullFiles: true}); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if e = c.SetFlagStates(map[Flag]bool{Flag(0): true}); e == nil {
+		t.Errorf("c.SetFlagStates() should return an error for an invalid flag")
+	}
+	if e = c.SetSensitivityStates(map[SensiOption]bool{Trojan: true, Worm: false}); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	var re *ResponseError
+	if e = c.SetSensitivityStates(map[SensiOption]bool{Pube: true}); !errors.As(e, &re) || re.Code != 501 {
+		t.Errorf("c.SetSensitivityStates() = %v, want the daemon error", e)
+	}
+	want := []string{"FLAGS +fullfiles -scandevices", "SENSITIVITY -worm +trojan", "SENSITIVITY +pube"}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+}
+
+func TestVpsInfo(t *testing.T) {
+	tests := []struct {
+		line    string
+		version int
+		date    time.Time
+		err     bool
+	}{
+		{"VPS 18061402", 18061402, ZeroTime, false},
+		{"VPS 18061402 2018-06-14", 18061402, time.Date(2018, 6, 14, 0, 0, 0, 0, time.UTC), false},
+		{"VPS 18061402 build 7 2018/06/14 extra", 18061402, time.Date(2018, 6, 14, 0, 0, 0, 0, time.UTC), false},
+		{"VPS abc", 0, ZeroTime, true},
+		{"FLAGS 1", 0, ZeroTime, true},
+	}
+	for _, tt := range tests {
+		line := tt.line
+		address := fakeServer(t, func(n int, l string) []string {
+			return []string{"210 VPS DATA", line, "200 VPS OK"}
+		})
+		c, e := NewClient(context.Background(), address, time.Second, time.Second)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		v, e := c.VpsInfo()
+		c.Close()
+		if tt.err {
+			if e == nil {
+				t.Errorf("c.VpsInfo() with %q should return an error", tt.line)
+			}
+			continue
+		}
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if v.Version != tt.version || !v.Date.Equal(tt.date) {
+			t.Errorf("c.VpsInfo() with %q = %+v, want %d %s", tt.line, v, tt.version, tt.date)
+		}
+	}
+}
+
+func TestAutoReconnect(t *testing.T) {
+	handler := func(n int, l string) []string {
+		if n == 0 && strings.HasPrefix(l, Vps.String()) {
+			return []string{avasttest.CloseConn}
+		}
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	}
+	c, e := NewClient(context.Background(), fakeServer(t, handler), time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if v, e := c.Vps(); e != nil || v != 123456 {
+		t.Errorf("c.Vps() = %d, %v, want the command replayed on a new connection", v, e)
+	}
+
+	c, e = NewClient(context.Background(), fakeServer(t, handler), time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	c.SetAutoReconnect(false)
+	if _, e = c.Vps(); !errors.Is(e, io.EOF) {
+		t.Errorf("c.Vps() = %v, want %v", e, io.EOF)
+	}
+}
+
+func TestNewClientWithOptions(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	c, e := NewClientWithOptions(context.Background(), address,
+		WithConnTimeout(2*time.Second),
+		WithCmdTimeout(3*time.Second),
+		WithConnRetries(4),
+		WithConnSleep(5*time.Second),
+		WithAutoReconnect(false),
+		WithTmpDir("/var/tmp"))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if c.ConnTimeout() != 2*time.Second || c.CmdTimeout() != 3*time.Second {
+		t.Errorf("timeouts = %s, %s, want %s, %s", c.ConnTimeout(), c.CmdTimeout(), 2*time.Second, 3*time.Second)
+	}
+	if c.ConnRetries() != 4 || c.ConnSleep() != 5*time.Second {
+		t.Errorf("retries = %d, %s, want %d, %s", c.ConnRetries(), c.ConnSleep(), 4, 5*time.Second)
+	}
+	if c.autoReconnect || c.tmpDir != "/var/tmp" {
+		t.Errorf("autoReconnect = %t, tmpDir = %q", c.autoReconnect, c.tmpDir)
+	}
+	c2, e := NewClient(context.Background(), address, time.Second, time.Second, WithCmdTimeout(7*time.Second))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c2.Close()
+	if c2.ConnTimeout() != time.Second || c2.CmdTimeout() != 7*time.Second {
+		t.Errorf("timeouts = %s, %s, want the option to take precedence", c2.ConnTimeout(), c2.CmdTimeout())
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var lines []string
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			return []string{"210 SCAN DATA", "SCAN /tmp/clean.txt\t[+]0.0", scanOkResp}
+		}
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithLogger(func(id uint, d, l string) {
+		lines = append(lines, fmt.Sprintf("%d %s %s", id, d, l))
+	}))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if _, e = c.Vps(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = c.Scan("/tmp/clean.txt"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	want := []string{
+		"0 send VPS",
+		"0 receive 210 VPS DATA",
+		"0 receive VPS 123456",
+		"0 receive 200 VPS OK",
+		"1 send SCAN /tmp/clean.txt",
+		"1 receive 210 SCAN DATA",
+		"1 receive SCAN /tmp/clean.txt\t[+]0.0",
+		"1 receive 200 SCAN OK",
+	}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("logged %q, want %q", lines, want)
+	}
+	c.SetLogger(nil)
+	lines = nil
+	if _, e = c.Vps(); e != nil || len(lines) != 0 {
+		t.Errorf("c.Vps() = %v logged %q with no logger", e, lines)
+	}
+}
+
+func TestScanPathControlChars(t *testing.T) {
+	var sent []string
+	address := fakeServer(t, func(n int, l string) []string {
+		sent = append(sent, l)
+		if strings.HasPrefix(l, Exclude.String()) {
+			return []string{excludeOKResp}
+		}
+		p := strings.TrimPrefix(l, Scan.String()+" ")
+		return []string{"210 SCAN DATA", "SCAN " + p + "\t[+]0.0", scanOkResp}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.Scan("/tmp/with space.txt")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Filename != "/tmp/with space.txt" {
+		t.Errorf("c.Scan() = %v, want a result for %q", r, "/tmp/with space.txt")
+	}
+	for _, p := range []string{"/tmp/a\nSCAN /etc/passwd", "/tmp/a\tb", "/tmp/a\rb"} {
+		if _, e = c.Scan(p); !errors.Is(e, ErrInvalidPath) {
+			t.Errorf("c.Scan(%q) = %v, want %v", p, e, ErrInvalidPath)
+		}
+	}
+	if e = c.SetExclude("/tmp/a\nQUIT"); !errors.Is(e, ErrInvalidPath) {
+		t.Errorf("c.SetExclude() = %v, want %v", e, ErrInvalidPath)
+	}
+	for _, p := range []string{"", "tmp/relative", "./tmp"} {
+		if e = c.SetExclude(p); e == nil || e.Error() != fmt.Sprintf(excludePathErr, p) {
+			t.Errorf("c.SetExclude(%q) = %v, want %q", p, e, fmt.Sprintf(excludePathErr, p))
+		}
+	}
+	if len(sent) != 1 {
+		t.Errorf("sent %q, want only the valid scan", sent)
+	}
+}
+
+func TestScanPaths(t *testing.T) {
+	var sent []string
+	address := fakeServer(t, func(n int, l string) []string {
+		sent = append(sent, l)
+		p := strings.TrimPrefix(l, Scan.String()+" ")
+		switch p {
+		case "/tmp/archive.zip":
+			return []string{
+				"210 SCAN DATA",
+				"SCAN /tmp/archive.zip|>a.txt\t[+]1.0",
+				"SCAN /tmp/archive.zip|>b.exe\t[L]1.0\tEICAR Test-NOT virus!!!",
+				"SCAN /tmp/archive.zip\t[+]0.0",
+				scanOkResp,
+			}
+		case "/tmp/missing":
+			return []string{"520 Scan failed"}
+		}
+		return []string{"210 SCAN DATA", "SCAN " + p + "\t[+]0.0", scanOkResp}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.ScanPaths(context.Background(), []string{"/tmp/b.txt", "/tmp/archive.zip", "/tmp/missing", "/tmp/b.txt", "/tmp/a.txt"})
+	var re *ResponseError
+	if !errors.As(e, &re) || re.Code != 520 {
+		t.Errorf("c.ScanPaths() = %v, want the error for /tmp/missing", e)
+	}
+	want := []string{"/tmp/b.txt", "/tmp/archive.zip", "/tmp/archive.zip", "/tmp/archive.zip", "/tmp/a.txt"}
+	if len(r) != len(want) {
+		t.Fatalf("c.ScanPaths() = %d results, want %d", len(r), len(want))
+	}
+	for i, p := range want {
+		if r[i].Path != p {
+			t.Errorf("r[%d].Path = %q, want %q", i, r[i].Path, p)
+		}
+	}
+	if len(sent) != 4 {
+		t.Errorf("sent %q, want each path scanned once", sent)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	r := []*Response{
+		{Filename: "/tmp/a", Infected: true, Signature: "Win32:Malware-gen"},
+		{Filename: "/tmp/b"},
+		{Filename: "/tmp/c", Infected: true, Signature: "EICAR Test-NOT virus!!!"},
+		{Filename: "/tmp/d", Errored: true, Signature: "Error 13 Permission denied"},
+		{Filename: "/tmp/e", Infected: true, Signature: "EICAR Test-NOT virus!!!"},
+	}
+	s := Summarize(r)
+	if s.Clean != 1 || s.Infected != 3 || s.Errored != 1 || !s.AnyInfected() {
+		t.Errorf("Summarize() = %+v, want 1 clean, 3 infected and 1 errored", s)
+	}
+	want := []string{"EICAR Test-NOT virus!!!", "Win32:Malware-gen"}
+	if strings.Join(s.Signatures, "|") != strings.Join(want, "|") {
+		t.Errorf("Summarize().Signatures = %q, want %q", s.Signatures, want)
+	}
+	if s = Summarize(nil); s.AnyInfected() || s.Clean != 0 {
+		t.Errorf("Summarize(nil) = %+v, want an empty summary", s)
+	}
+}
+
+func TestCheckURLs(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		u := strings.TrimPrefix(l, CheckURL.String()+" ")
+		switch u {
+		case "http://bad.example.com/":
+			return []string{"520 " + u + "\t" + urlBlockedResp}
+		case "bogus":
+			return []string{"501 Malformed URL"}
+		}
+		return []string{"200 OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.CheckURLs(context.Background(), []string{"http://good.example.com/", "bogus", "http://bad.example.com/"})
+	if e == nil || !strings.Contains(e.Error(), "bogus") {
+		t.Errorf("c.CheckURLs() = %v, want an error for %q", e, "bogus")
+	}
+	if len(r) != 2 || r["http://good.example.com/"] || !r["http://bad.example.com/"] {
+		t.Errorf("c.CheckURLs() = %v, want good allowed and bad blocked", r)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if r, e = c.CheckURLs(ctx, []string{"http://good.example.com/"}); !errors.Is(e, context.Canceled) || len(r) != 0 {
+		t.Errorf("c.CheckURLs() = %v, %v, want %v", r, e, context.Canceled)
+	}
+}
+
+func TestCheckURLResult(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		u := strings.TrimPrefix(l, CheckURL.String()+" ")
+		switch u {
+		case "http://phish.example.com/":
+			return []string{"520 " + u + "\t" + urlBlockedResp + "\tPhishing"}
+		case "http://bad.example.com/":
+			return []string{"520 " + u + "\t" + urlBlockedResp}
+		}
+		return []string{"200 OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	tests := []struct {
+		url     string
+		blocked bool
+		reason  string
+	}{
+		{"http://phish.example.com/", true, "Phishing"},
+		{"http://bad.example.com/", true, ""},
+		{"http://good.example.com/", false, ""},
+	}
+	for _, tt := range tests {
+		r, e := c.CheckURLResult(context.Background(), tt.url)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if r.Blocked != tt.blocked || r.Reason != tt.reason || r.Raw == "" {
+			t.Errorf("c.CheckURLResult(%q) = %+v, want blocked %t reason %q", tt.url, r, tt.blocked, tt.reason)
+		}
+	}
+}
+
+func TestCheckURLMultiline(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		u := strings.TrimPrefix(l, CheckURL.String()+" ")
+		if u == "http://redirect.example.com/" {
+			return []string{
+				"520-" + u + "\t" + urlBlockedResp + "\tRedirect",
+				"520 " + u + "\t" + urlBlockedResp + "\tPhishing",
+			}
+		}
+		return []string{"200 OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.CheckURLResult(context.Background(), "http://redirect.example.com/")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !r.Blocked || r.Reason != "Redirect; Phishing" || strings.Count(r.Raw, "\n") != 1 {
+		t.Errorf("c.CheckURLResult() = %+v, want both lines", r)
+	}
+	if b, e := c.CheckURL("http://good.example.com/"); e != nil || b {
+		t.Errorf("c.CheckURL() = %t, %v, want the next reply to stay aligned", b, e)
+	}
+}
+
+func TestVpsMalformed(t *testing.T) {
+	tests := []struct {
+		line string
+		v    int
+		err  bool
+	}{
+		{"VPS 123456", 123456, false},
+		{"VPS   123456  ", 123456, false},
+		{"VPS ", 0, true},
+		{"VPS", 0, true},
+		{"VP", 0, true},
+		{"", 0, true},
+		{"VPS 12a456", 0, true},
+	}
+	for _, tt := range tests {
+		line := tt.line
+		address := fakeServer(t, func(n int, l string) []string {
+			return []string{"210 VPS DATA", line, "200 VPS OK"}
+		})
+		c, e := NewClient(context.Background(), address, time.Second, time.Second)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		v, e := c.Vps()
+		c.Close()
+		if tt.err {
+			var re *ResponseError
+			if !errors.As(e, &re) || !strings.Contains(e.Error(), fmt.Sprintf("%q", tt.line)) {
+				t.Errorf("c.Vps() with %q = %v, want an invalid response error quoting the line", tt.line, e)
+			}
+			continue
+		}
+		if e != nil || v != tt.v {
+			t.Errorf("c.Vps() with %q = %d, %v, want %d", tt.line, v, e, tt.v)
+		}
+	}
+}
+
+func TestOverridePackOptions(t *testing.T) {
+	var sent []string
+	address := fakeServer(t, func(n int, l string) []string {
+		sent = append(sent, l)
+		if l == Pack.String() {
+			return []string{"210 PACK DATA", "PACK +mime -zip +rar", "200 PACK OK"}
+		}
+		if strings.Contains(l, "+tar") {
+			return []string{"501 Bad option"}
+		}
+		return []string{"210 PACK DATA", l, "200 PACK OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	restore, e := c.OverridePackOptions(map[PackOption]bool{Zip: true, Rar: false})
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if e = restore(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	want := []string{"PACK", "PACK +zip -rar", "PACK +mime -zip +rar"}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+	sent = nil
+	if restore, e = c.OverridePackOptions(map[PackOption]bool{Tar: true}); e == nil || restore != nil {
+		t.Errorf("c.OverridePackOptions() should return an error")
+	}
+	want = []string{"PACK", "PACK +tar", "PACK +mime -zip +rar"}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+
+	address = fakeServer(t, func(n int, l string) []string {
+		if l == Pack.String() {
+			return []string{"210 PACK DATA", "PACK +mime -zip +rar", "200 PACK OK"}
+		}
+		return []string{"501 Bad option"}
+	})
+	c2, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c2.Close()
+	_, e = c2.OverridePackOptions(map[PackOption]bool{Tar: true})
+	if je, ok := e.(interface{ Unwrap() []error }); !ok || len(je.Unwrap()) != 2 {
+		t.Errorf("c.OverridePackOptions() = %v, want the apply and restore errors", e)
+	}
+}
+
+func TestScanStream(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasSuffix(l, "/tmp/bad") {
+			return []string{"210 SCAN DATA", "SCAN /tmp/bad/a\t[+]0.0", "SCAN broken", scanOkResp}
+		}
+		return []string{
+			"210 SCAN DATA",
+			"SCAN /tmp/dir/a\t[+]0.0",
+			"SCAN /tmp/dir/b\t[L]0.0\tEICAR Test-NOT virus!!!",
+			"SCAN /tmp/dir/c\t[+]0.0",
+			scanOkResp,
+		}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	rc, ec := c.ScanStream(context.Background(), "/tmp/dir")
+	var names []string
+	for rs := range rc {
+		if rs.Path != "/tmp/dir" {
+			t.Errorf("rs.Path = %q, want %q", rs.Path, "/tmp/dir")
+		}
+		names = append(names, rs.Filename)
+	}
+	if e = <-ec; e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if strings.Join(names, ",") != "/tmp/dir/a,/tmp/dir/b,/tmp/dir/c" {
+		t.Errorf("c.ScanStream() = %q, want three results in order", names)
+	}
+	rc, ec = c.ScanStream(context.Background(), "/tmp/bad")
+	n := 0
+	for range rc {
+		n++
+	}
+	var re *ResponseError
+	if e = <-ec; !errors.As(e, &re) || n != 1 {
+		t.Errorf("c.ScanStream() = %d results, %v, want 1 result and a ResponseError", n, e)
+	}
+}
+
+func TestContextWithCmdTimeout(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			time.Sleep(300 * time.Millisecond)
+			return []string{"210 SCAN DATA", "SCAN /tmp/big.zip\t[+]0.0", scanOkResp}
+		}
+		time.Sleep(100 * time.Millisecond)
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, 200*time.Millisecond)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if _, e = c.ScanContext(ContextWithCmdTimeout(context.Background(), time.Second), "/tmp/big.zip"); e != nil {
+		t.Errorf("c.ScanContext() = %v, want the longer timeout to be used", e)
+	}
+	if c.CmdTimeout() != 200*time.Millisecond {
+		t.Errorf("c.CmdTimeout() = %s, want %s", c.CmdTimeout(), 200*time.Millisecond)
+	}
+	if _, e = c.VpsContext(ContextWithCmdTimeout(context.Background(), 20*time.Millisecond)); e == nil {
+		t.Errorf("c.VpsContext() should time out with the shorter timeout")
+	}
+}
+
+func TestGreeting(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if g := c.Greeting(); g != "DAEMON" {
+		t.Errorf("c.Greeting() = %q, want %q", g, "DAEMON")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	type spanKey struct{}
+	var spans []string
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			return []string{"210 SCAN DATA", "SCAN /tmp/dir/a\t[+]0.0", "SCAN /tmp/dir/b\t[+]0.0", scanOkResp}
+		}
+		return []string{"451 Engine error"}
+	})
+	tracer := func(ctx context.Context, cmd Command, arg string) (context.Context, func(int, error)) {
+		ctx = context.WithValue(ctx, spanKey{}, cmd.String())
+		return ctx, func(n int, err error) {
+			spans = append(spans, fmt.Sprintf("%s %s %d %t", ctx.Value(spanKey{}), arg, n, err != nil))
+		}
+	}
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithTracer(tracer))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if _, e = c.Scan("/tmp/dir"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = c.Vps(); e == nil {
+		t.Errorf("c.Vps() should return an error")
+	}
+	want := []string{"SCAN /tmp/dir 2 false", "VPS  0 true"}
+	if strings.Join(spans, "|") != strings.Join(want, "|") {
+		t.Errorf("spans = %q, want %q", spans, want)
+	}
+}
+
+type testMetrics struct {
+	commands   []string
+	infected   int
+	reconnects int
+}
+
+func (m *testMetrics) OnCommand(cmd Command, dur time.Duration, err error) {
+	m.commands = append(m.commands, fmt.Sprintf("%s %t", cmd, err != nil))
+}
+
+func (m *testMetrics) OnScanResult(r *Response) {
+	if r.Infected {
+		m.infected++
+	}
+}
+
+func (m *testMetrics) OnReconnect(err error) {
+	m.reconnects++
+}
+
+func TestMetrics(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			return []string{"210 SCAN DATA", "SCAN /tmp/dir/a\t[L]0.0\tEICAR Test-NOT virus!!!", "SCAN /tmp/dir/b\t[+]0.0", scanOkResp}
+		}
+		if n == 0 {
+			return []string{avasttest.CloseConn}
+		}
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	m := &testMetrics{}
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithMetrics(m))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if _, e = c.Scan("/tmp/dir"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = c.Vps(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	want := []string{"SCAN false", "VPS false"}
+	if strings.Join(m.commands, "|") != strings.Join(want, "|") {
+		t.Errorf("commands = %q, want %q", m.commands, want)
+	}
+	if m.infected != 1 || m.reconnects != 1 {
+		t.Errorf("infected = %d, reconnects = %d, want 1 and 1", m.infected, m.reconnects)
+	}
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			p := strings.TrimPrefix(l, Scan.String()+" ")
+			return []string{"210 SCAN DATA", "SCAN " + p + "\t[+]0.0", scanOkResp}
+		}
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithCaptureFraming())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		p := fmt.Sprintf("/tmp/file%d", i)
+		go func() {
+			r, e := c.Scan(p)
+			if e == nil && (len(r) != 1 || r[0].Filename != p) {
+				e = fmt.Errorf("c.Scan(%q) = %v", p, r)
+			}
+			errs <- e
+		}()
+		go func() {
+			v, e := c.Vps()
+			if e == nil && v != 123456 {
+				e = fmt.Errorf("c.Vps() = %d", v)
+			}
+			errs <- e
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if e := <-errs; e != nil {
+			t.Errorf("An error should not be returned: %s", e)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	pack := DefaultPackOptions()
+	if len(pack) != len(AllPackOptions()) {
+		t.Errorf("DefaultPackOptions() has %d options, want %d", len(pack), len(AllPackOptions()))
+	}
+	flags := DefaultFlags()
+	if len(flags) != len(AllFlags()) || !flags[FullFiles] || flags[AllFiles] {
+		t.Errorf("DefaultFlags() = %v, want every flag with only fullfiles enabled", flags)
+	}
+	sensi := DefaultSensitivity()
+	if len(sensi) != len(AllSensiOptions()) || !sensi[Worm] || sensi[Pup] {
+		t.Errorf("DefaultSensitivity() = %v, want every option with pup disabled", sensi)
+	}
+	pack[Mime] = false
+	flags[FullFiles] = false
+	if !DefaultPackOptions()[Mime] || !DefaultFlags()[FullFiles] {
+		t.Errorf("the default maps should be new on each call")
+	}
+}
+
+func TestResetServerConfig(t *testing.T) {
+	var sent []string
+	address := fakeServer(t, func(n int, l string) []string {
+		sent = append(sent, l)
+		c := strings.Fields(l)[0]
+		return []string{"210 " + c + " DATA", l, "200 " + c + " OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if e = c.ResetServerConfig(context.Background()); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(sent) != 3 {
+		t.Fatalf("sent %q, want 3 commands", sent)
+	}
+	if want := "PACK +" + strings.Replace(EncodePackOptions(AllPackOptions()), ",", " +", -1); sent[0] != want {
+		t.Errorf("sent %q, want %q", sent[0], want)
+	}
+	if want := "FLAGS +fullfiles -allfiles -scandevices"; sent[1] != want {
+		t.Errorf("sent %q, want %q", sent[1], want)
+	}
+	if !strings.HasPrefix(sent[2], "SENSITIVITY +worm") || !strings.HasSuffix(sent[2], "-pup -suspicious -pube") {
+		t.Errorf("sent %q, want the default sensitivity", sent[2])
+	}
+}
+
+func TestTLS(t *testing.T) {
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	cert, e := x509.ParseCertificate(der)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	l, e := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tc := textproto.NewConn(conn)
+				tc.PrintfLine("220 DAEMON")
+				for {
+					line, e := tc.ReadLine()
+					if e != nil || line == Quit.String() {
+						return
+					}
+					tc.PrintfLine("210 VPS DATA")
+					tc.PrintfLine("VPS 123456")
+					tc.PrintfLine("200 VPS OK")
+				}
+			}()
+		}
+	}()
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	c, e := NewClient(context.Background(), l.Addr().String(), time.Second, time.Second, WithTLS(&tls.Config{RootCAs: pool}))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if c.Greeting() != "DAEMON" {
+		t.Errorf("c.Greeting() = %q, want %q", c.Greeting(), "DAEMON")
+	}
+	if v, e := c.Vps(); e != nil || v != 123456 {
+		t.Errorf("c.Vps() = %d, %v, want %d", v, e, 123456)
+	}
+	if _, e = NewClient(context.Background(), l.Addr().String(), time.Second, time.Second, WithTLS(&tls.Config{})); e == nil {
+		t.Errorf("NewClient() should fail to verify an untrusted certificate")
+	}
+	if _, e = NewClient(context.Background(), "/tmp/avast.sock", time.Second, time.Second, WithTLS(&tls.Config{})); e == nil || e.Error() != tlsUnixErr {
+		t.Errorf("NewClient() = %v, want %q", e, tlsUnixErr)
+	}
+}
+
+func TestCloseHalfOpen(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{avasttest.CloseConn}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithAutoReconnect(false))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if _, e = c.Vps(); e == nil {
+		t.Fatalf("c.Vps() should fail on the closed connection")
+	}
+	if e = c.Close(); e != nil {
+		t.Errorf("c.Close() = %v, want nil", e)
+	}
+	if e = c.Close(); e != nil {
+		t.Errorf("c.Close() = %v, want nil on a second call", e)
+	}
+	if _, e = c.Vps(); !errors.Is(e, net.ErrClosed) {
+		t.Errorf("c.Vps() = %v, want %v after Close", e, net.ErrClosed)
+	}
+}
+
+func TestCmdRetries(t *testing.T) {
+	var vps, flags int
+	address := fakeServer(t, func(n int, l string) []string {
+		switch {
+		case strings.HasPrefix(l, Vps.String()):
+			vps++
+			if vps == 1 {
+				return []string{"421 Service busy"}
+			}
+			return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+		case strings.HasPrefix(l, Flags.String()):
+			flags++
+			return []string{"210 FLAGS DATA", "garbage", "200 FLAGS OK"}
+		case strings.HasPrefix(l, Scan.String()):
+			if n == 0 {
+				return []string{"210 SCAN DATA", avasttest.CloseConn}
+			}
+			return []string{"210 SCAN DATA", "SCAN /tmp/eicar.com\t[L]0.0\tEICAR Test-NOT virus!!!", scanOkResp}
+		}
+		return nil
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second,
+		WithCmdRetries(2), WithConnSleep(10*time.Millisecond), WithAutoReconnect(false))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if c.CmdRetries() != 2 {
+		t.Errorf("c.CmdRetries() = %d, want %d", c.CmdRetries(), 2)
+	}
+	if v, e := c.Vps(); e != nil || v != 123456 || vps != 2 {
+		t.Errorf("c.Vps() = %d, %v after %d attempts, want a retry after the busy reply", v, e, vps)
+	}
+	if _, e = c.GetFlags(); e == nil || flags != 1 {
+		t.Errorf("c.GetFlags() = %v after %d attempts, want a malformed reply not retried", e, flags)
+	}
+	r, e := c.Scan("/tmp/eicar.com")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || !r[0].Infected {
+		t.Errorf("c.Scan() = %v, want the infected result after reconnecting", r)
+	}
+}
+
+func TestWithDialer(t *testing.T) {
+	var dialed []string
+	dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		if len(dialed) == 1 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: os.ErrDeadlineExceeded}
+		}
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			tc := textproto.NewConn(server)
+			tc.PrintfLine("220 PIPE")
+			for {
+				line, e := tc.ReadLine()
+				if e != nil || line == Quit.String() {
+					return
+				}
+				tc.PrintfLine("210 VPS DATA")
+				tc.PrintfLine("VPS 123456")
+				tc.PrintfLine("200 VPS OK")
+			}
+		}()
+		return client, nil
+	}
+	c, e := NewClient(context.Background(), "/nonexistent/avast.sock", time.Second, time.Second,
+		WithDialer(dialer), WithConnRetries(1), WithConnSleep(10*time.Millisecond))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if len(dialed) != 2 || dialed[0] != "unix /nonexistent/avast.sock" {
+		t.Errorf("dialed %q, want two attempts on the unix address", dialed)
+	}
+	if c.Greeting() != "PIPE" {
+		t.Errorf("c.Greeting() = %q, want %q", c.Greeting(), "PIPE")
+	}
+	if v, e := c.Vps(); e != nil || v != 123456 {
+		t.Errorf("c.Vps() = %d, %v, want %d", v, e, 123456)
+	}
+}
+
+func TestNewClientCancelDuringRetrySleep(t *testing.T) {
+	dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.ErrDeadlineExceeded}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, e := NewClient(ctx, "/nonexistent/avast.sock", time.Second, time.Second,
+		WithDialer(dialer), WithConnRetries(5), WithConnSleep(10*time.Second))
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("NewClient() = %v, want %v", e, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("NewClient() returned after %s, want it to stop sleeping on cancellation", d)
+	}
+}
+
+func TestGetExcludes(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  []string
+		first string
+	}{
+		{[]string{"EXCLUDE"}, nil, ""},
+		{[]string{"EXCLUDE /var/spool"}, []string{"/var/spool"}, "/var/spool"},
+		{[]string{"EXCLUDE /var/spool", "EXCLUDE /tmp/with space"}, []string{"/var/spool", "/tmp/with space"}, "/var/spool"},
+		{[]string{"EXCLUDE /a /b/c d /e"}, []string{"/a", "/b/c d", "/e"}, "/a /b/c d /e"},
+	}
+	for _, tt := range tests {
+		reply := append(append([]string{"210 EXCLUDE DATA"}, tt.lines...), excludeOKResp)
+		address := fakeServer(t, func(n int, l string) []string {
+			return reply
+		})
+		c, e := NewClient(context.Background(), address, time.Second, time.Second)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		r, e := c.GetExcludes(context.Background())
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if strings.Join(r, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("c.GetExcludes() with %q = %q, want %q", tt.lines, r, tt.want)
+		}
+		if s, e := c.GetExclude(); e != nil || s != tt.first {
+			t.Errorf("c.GetExclude() with %q = %q, %v, want %q", tt.lines, s, e, tt.first)
+		}
+		c.Close()
+	}
+}
+
+func TestInfections(t *testing.T) {
+	r := []*Response{
+		{Filename: "/tmp/a"},
+		{Filename: "/tmp/b", Infected: true},
+		{Filename: "/tmp/c", Errored: true},
+		{Filename: "/tmp/d", Infected: true},
+	}
+	if !AnyInfected(r) || AnyInfected(r[:1]) || AnyInfected(nil) {
+		t.Errorf("AnyInfected() returned the wrong result")
+	}
+	i := Infections(r)
+	if len(i) != 2 || i[0].Filename != "/tmp/b" || i[1].Filename != "/tmp/d" {
+		t.Errorf("Infections() = %v, want /tmp/b and /tmp/d", i)
+	}
+	var n *Response
+	if n.IsInfected() || r[2].IsInfected() || !r[1].IsInfected() {
+		t.Errorf("IsInfected() returned the wrong result")
+	}
+}
+
+func TestScanWithSettings(t *testing.T) {
+	var sent []string
+	address := fakeServer(t, func(n int, l string) []string {
+		sent = append(sent, l)
+		switch l {
+		case Flags.String():
+			return []string{"210 FLAGS DATA", "FLAGS +fullfiles -allfiles -scandevices", "200 FLAGS OK"}
+		case Sensitivity.String():
+			return []string{"210 SENSITIVITY DATA", "SENSITIVITY +worm -pup -pube", "200 SENSITIVITY OK"}
+		}
+		if strings.HasPrefix(l, Scan.String()) {
+			return []string{"210 SCAN DATA", "SCAN /tmp/sample\t[L]0.0\tEICAR Test-NOT virus!!!", scanOkResp}
+		}
+		c := strings.Fields(l)[0]
+		return []string{"210 " + c + " DATA", l, "200 " + c + " OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.ScanWithSettings(context.Background(), "/tmp/sample", ScanSettings{
+		Flags:       map[Flag]bool{AllFiles: true},
+		Sensitivity: map[SensiOption]bool{Pup: true, Pube: true},
+	})
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if !AnyInfected(r) {
+		t.Errorf("c.ScanWithSettings() = %v, want an infection", r)
+	}
+	want := []string{
+		"FLAGS",
+		"SENSITIVITY",
+		"FLAGS +allfiles",
+		"SENSITIVITY +pup +pube",
+		"SCAN /tmp/sample",
+		"FLAGS +fullfiles -allfiles -scandevices",
+		"SENSITIVITY +worm -pup -pube",
+	}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	var m sync.Mutex
+	var sent []string
+	queried := make(chan struct{})
+	address := fakeServer(t, func(n int, l string) []string {
+		m.Lock()
+		sent = append(sent, l)
+		m.Unlock()
+		if l == Flags.String() {
+			close(queried)
+			time.Sleep(50 * time.Millisecond)
+			return []string{"210 FLAGS DATA", "FLAGS +fullfiles -allfiles -scandevices", "200 FLAGS OK"}
+		}
+		c := strings.Fields(l)[0]
+		return []string{"210 " + c + " DATA", l, "200 " + c + " OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	done := make(chan error)
+	go func() {
+		<-queried
+		_, err := c.GetSensitivity()
+		done <- err
+	}()
+	if e = c.ApplyProfile(Profile{Flags: map[Flag]bool{AllFiles: true}}); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if e = <-done; e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	want := []string{"FLAGS", "FLAGS +allfiles", "SENSITIVITY"}
+	m.Lock()
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+	sent = nil
+	m.Unlock()
+
+	for _, p := range []Profile{
+		{Flags: map[Flag]bool{AllFiles: true}, Exclude: "relative/path"},
+		{Flags: map[Flag]bool{AllFiles: true}, Pack: map[PackOption]bool{PackOption(99): true}},
+		{Pack: map[PackOption]bool{Zip: false}, Sensitivity: map[SensiOption]bool{SensiOption(99): true}},
+	} {
+		if e = c.ApplyProfile(p); e == nil {
+			t.Errorf("c.ApplyProfile(%v) should return an error", p)
+		}
+	}
+	m.Lock()
+	defer m.Unlock()
+	if len(sent) != 0 {
+		t.Errorf("an invalid profile sent %q, want nothing", sent)
+	}
+}
+
+func TestLastStatus(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Vps.String()) {
+			return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+		}
+		return []string{"210 SCAN DATA", "SCAN /tmp/dir/a\t[+]0.0", "SCAN /tmp/dir/b\t[+]0.0", scanOkResp + " 2 files"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.Scan("/tmp/dir")
+	if e != nil || len(r) != 2 {
+		t.Fatalf("c.Scan() = %d results, %v, want 2 results", len(r), e)
+	}
+	if code, msg := c.LastStatus(); code != 200 || msg != "SCAN OK 2 files" {
+		t.Errorf("c.LastStatus() = %d, %q, want %d, %q", code, msg, 200, "SCAN OK 2 files")
+	}
+	if _, e = c.Vps(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if code, msg := c.LastStatus(); code != 200 || msg != "VPS OK" {
+		t.Errorf("c.LastStatus() = %d, %q, want %d, %q", code, msg, 200, "VPS OK")
+	}
+}
+
+func TestClone(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	var logged int
+	c, e := NewClient(context.Background(), address, 2*time.Second, 3*time.Second,
+		WithConnRetries(4), WithCmdRetries(2), WithAutoReconnect(false),
+		WithLogger(func(id uint, direction, line string) { logged++ }))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	n, e := c.Clone(context.Background())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer n.Close()
+	if n.conn == c.conn {
+		t.Errorf("c.Clone() should dial a new connection")
+	}
+	if n.ConnTimeout() != c.ConnTimeout() || n.CmdTimeout() != c.CmdTimeout() ||
+		n.ConnRetries() != c.ConnRetries() || n.CmdRetries() != c.CmdRetries() || n.autoReconnect {
+		t.Errorf("c.Clone() did not copy the client settings")
+	}
+	if v, e := n.Vps(); e != nil || v != 123456 {
+		t.Errorf("n.Vps() = %d, %v, want %d", v, e, 123456)
+	}
+	if logged == 0 {
+		t.Errorf("c.Clone() did not copy the logger")
+	}
+}
+
+func TestScanAndAct(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{
+			"210 SCAN DATA",
+			"SCAN /tmp/dir/a.zip|>x.com\t[L]1.0\t0 EICAR Test-NOT virus!!!",
+			"SCAN /tmp/dir/a.zip|>y.com\t[L]1.0\t0 EICAR Test-NOT virus!!!",
+			"SCAN /tmp/dir/b.txt\t[+]0.0",
+			"SCAN /tmp/dir/c.com\t[L]0.0\t0 EICAR Test-NOT virus!!!",
+			scanOkResp,
+		}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	var acted []string
+	failed := errors.New("move failed")
+	r, e := c.ScanAndAct(context.Background(), "/tmp/dir", func(rs *Response) error {
+		acted = append(acted, rs.Filename)
+		if rs.Filename == "/tmp/dir/a.zip" {
+			return failed
+		}
+		return nil
+	})
+	if len(r) != 4 {
+		t.Errorf("c.ScanAndAct() returned %d results, want %d", len(r), 4)
+	}
+	if !errors.Is(e, failed) || !strings.Contains(e.Error(), "/tmp/dir/a.zip") {
+		t.Errorf("c.ScanAndAct() = %v, want the callback error", e)
+	}
+	if expected := "/tmp/dir/a.zip,/tmp/dir/c.com"; strings.Join(acted, ",") != expected {
+		t.Errorf("acted on %q, want %q", acted, expected)
+	}
+}
+
+func TestConnBackoff(t *testing.T) {
+	c := &Client{connSleep: DefaultSleep}
+	for i := 0; i < 3; i++ {
+		if d := c.backoff(i); d != DefaultSleep {
+			t.Errorf("c.backoff(%d) = %s, want the fixed sleep %s", i, d, DefaultSleep)
+		}
+	}
+	WithConnectBackoff(3, 100*time.Millisecond, time.Second)(c)
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{10, time.Second},
+	}
+	for _, tt := range tests {
+		for n := 0; n < 20; n++ {
+			if d := c.backoff(tt.attempt); d < tt.max/2 || d > tt.max {
+				t.Errorf("c.backoff(%d) = %s, want between %s and %s", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestCompatibilityCheck(t *testing.T) {
+	tests := []struct {
+		greeting string
+		vps      string
+		ok       bool
+	}{
+		{"DAEMON", "VPS 19052406", true},
+		{"DAEMON 4.0.1", "VPS 19052406", true},
+		{"DAEMON 5.1", "VPS 19052406", false},
+		{"OTHERD", "VPS 19052406", false},
+		{"DAEMON", "VPS 17052406", false},
+	}
+	for _, tt := range tests {
+		vps := tt.vps
+		address := fakeServer(t, func(n int, l string) []string {
+			return []string{"210 VPS DATA", vps, "200 VPS OK"}
+		})
+		c, e := NewClient(context.Background(), address, time.Second, time.Second)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		c.greeting = tt.greeting
+		if e = c.CompatibilityCheck(); (e == nil) != tt.ok || (e != nil && !errors.Is(e, ErrUntestedDaemon)) {
+			t.Errorf("c.CompatibilityCheck() with %q, %q = %v, want ok %t", tt.greeting, vps, e, tt.ok)
+		}
+		var ue *UntestedDaemonError
+		if e != nil && (!errors.As(e, &ue) || !strings.HasPrefix(ue.Error(), "The ")) {
+			t.Errorf("c.CompatibilityCheck() with %q, %q = %v, want an UntestedDaemonError", tt.greeting, vps, e)
+		}
+		c.Close()
+	}
+}
+
+func TestScanFile(t *testing.T) {
+	wd, e := os.Getwd()
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	address := fakeServer(t, func(n int, l string) []string {
+		p := strings.TrimPrefix(l, Scan.String()+" ")
+		switch {
+		case strings.HasSuffix(p, "skipped.txt"):
+			return []string{"210 SCAN DATA", scanOkResp}
+		case !filepath.IsAbs(p):
+			p = filepath.Join(wd, p)
+		}
+		return []string{"210 SCAN DATA", "SCAN " + p + "\t[+]0.0", scanOkResp}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithAbsolutePaths())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	tests := []struct {
+		in       string
+		filename string
+		err      error
+	}{
+		{"clean.txt", filepath.Join(wd, "clean.txt"), nil},
+		{"./dir/../clean.txt", filepath.Join(wd, "clean.txt"), nil},
+		{"/tmp/clean.txt", "/tmp/clean.txt", nil},
+		{"/tmp/skipped.txt", "", ErrNoResult},
+	}
+	for _, tt := range tests {
+		r, e := c.ScanFile(tt.in)
+		if tt.err != nil {
+			if !errors.Is(e, tt.err) {
+				t.Errorf("c.ScanFile(%q) = %v, want %v", tt.in, e, tt.err)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("c.ScanFile(%q) returned error: %s", tt.in, e)
+			continue
+		}
+		if len(r) != 1 || r[0].Filename != tt.filename {
+			t.Errorf("c.ScanFile(%q) = %v, want %q", tt.in, r, tt.filename)
+		}
+	}
+}
+
+func TestScanRoot(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		p := strings.TrimPrefix(l, Scan.String()+" ")
+		return []string{"210 SCAN DATA", "SCAN " + p + "\t[+]0.0", scanOkResp}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithScanRoot("/srv/data"))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	tests := []struct {
+		in   string
+		sent string
+	}{
+		{"mail/1.eml", "/srv/data/mail/1.eml"},
+		{"./mail/../2.eml", "/srv/data/2.eml"},
+		{"/tmp/3.eml", "/tmp/3.eml"},
+	}
+	for _, tt := range tests {
+		r, e := c.ScanFile(tt.in)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if len(r) != 1 || r[0].Filename != tt.sent {
+			t.Errorf("c.ScanFile(%q) = %v, want %q sent", tt.in, r, tt.sent)
+		}
+	}
+}
+
+func TestLastCommandDuration(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			return []string{"500 Unknown command"}
+		}
+		time.Sleep(50 * time.Millisecond)
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if _, e = c.Vps(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if d := c.LastCommandDuration(); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("c.LastCommandDuration() = %s, want at least %s", d, 50*time.Millisecond)
+	}
+	if _, e = c.Scan("/tmp/clean.txt"); e == nil {
+		t.Fatalf("An error should be returned")
+	}
+	if d := c.LastCommandDuration(); d != 0 {
+		t.Errorf("c.LastCommandDuration() = %s after a failed command, want 0", d)
+	}
+}
+
+func TestMaxIdle(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithMaxIdle(50*time.Millisecond))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	conn := c.conn
+	for i := 0; i < 2; i++ {
+		if _, e = c.Vps(); e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+	}
+	if c.conn != conn {
+		t.Errorf("the connection should be reused before the idle time")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, e = c.Vps(); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if c.conn == conn {
+		t.Errorf("an idle connection should be dialed again")
+	}
+}
+
+func TestScanStrayCR(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{
+			"210 SCAN DATA",
+			"SCAN /tmp/eicar.com\t[L]0.0\t0 EICAR Test-\rNOT virus!!!\r",
+			"SCAN /tmp/clean.txt\r\t[+]0.0\r",
+			scanOkResp + "\r",
+		}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.Scan("/tmp")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 2 || r[0].Filename != "/tmp/eicar.com" || r[0].Signature != "EICAR Test-NOT virus!!!" ||
+		r[1].Filename != "/tmp/clean.txt" || r[1].Infected {
+		t.Errorf("c.Scan() = %v, want the CR characters removed", r)
+	}
+}
+
+func TestGettersConcurrentWithCommands(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{"210 SCAN DATA", "SCAN /tmp/clean.txt\t[+]0.0", scanOkResp}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithTranscript(1024), WithCaptureFraming())
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			c.Scan("/tmp/clean.txt")
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if code, _ := c.LastStatus(); code != 200 {
+				t.Errorf("c.LastStatus() = %d, want %d", code, 200)
+			}
+			return
+		default:
+			c.LastStatus()
+			c.LastTranscript()
+			c.LastFraming()
+			c.LastCommandDuration()
+			c.Broken()
+			c.Greeting()
+		}
+	}
+}
+
+func TestSettersConcurrentWithCommands(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			return []string{"210 SCAN DATA", scanOkResp}
+		}
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			c.Vps()
+			c.Scan("clean.txt")
+			c.ScanReader(context.Background(), strings.NewReader("data"))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if c.CmdTimeout() != 2*time.Second || c.CmdRetries() != 1 {
+				t.Errorf("c.CmdTimeout(), c.CmdRetries() = %s, %d", c.CmdTimeout(), c.CmdRetries())
+			}
+			return
+		default:
+			c.SetCmdTimeout(2 * time.Second)
+			c.SetConnTimeout(time.Second)
+			c.SetConnRetries(1)
+			c.SetConnSleep(time.Millisecond)
+			c.SetCmdRetries(1)
+			c.SetMaxResults(100)
+			c.SetMaxIdle(time.Minute)
+			c.SetAutoReconnect(true)
+			c.SetLogger(func(id uint, direction, line string) {})
+			c.SetTracer(nil)
+			c.SetMetrics(nil)
+			c.SetScanRoot("/tmp")
+			c.SetTmpDir(os.TempDir())
+			c.ConnTimeout()
+			c.ConnRetries()
+			c.ConnSleep()
+		}
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		if strings.HasPrefix(l, Vps.String()) {
+			return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+		}
+		r := []string{"210 SCAN DATA"}
+		for i := 0; i < 5; i++ {
+			r = append(r, fmt.Sprintf("SCAN /tmp/dir/%d\t[+]0.0", i))
+		}
+		return append(r, scanOkResp)
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithMaxResults(5))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if r, e := c.Scan("/tmp/dir"); e != nil || len(r) != 5 {
+		t.Errorf("c.Scan() = %d results, %v, want 5 results", len(r), e)
+	}
+	c.SetMaxResults(3)
+	if _, e = c.Scan("/tmp/dir"); !errors.Is(e, ErrTooManyResults) {
+		t.Errorf("c.Scan() = %v, want %v", e, ErrTooManyResults)
+	}
+	if !c.Broken() {
+		t.Errorf("c.Broken() = false, want true after an aborted scan")
+	}
+	if v, e := c.Vps(); e != nil || v != 123456 {
+		t.Errorf("c.Vps() = %d, %v, want the client to reconnect", v, e)
+	}
+}
+
+func TestCheckURLsWithTimeout(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		switch l {
+		case "CHECKURL http://slow.example.com":
+			time.Sleep(200 * time.Millisecond)
+			return []string{"200 OK"}
+		case "CHECKURL http://bad.example.com":
+			return []string{"520 URL blocked"}
+		}
+		return []string{"200 OK"}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	urls := []string{"http://good.example.com", "http://slow.example.com", "http://bad.example.com"}
+	r, errs := c.CheckURLsWithTimeout(urls, 50*time.Millisecond)
+	if len(errs) != 1 || !errors.Is(errs["http://slow.example.com"], context.DeadlineExceeded) {
+		t.Errorf("c.CheckURLsWithTimeout() errors = %v, want a timeout for the slow URL", errs)
+	}
+	if b, ok := r["http://good.example.com"]; !ok || b {
+		t.Errorf("c.CheckURLsWithTimeout()[%q] = %t, want %t", "http://good.example.com", b, false)
+	}
+	if b, ok := r["http://bad.example.com"]; !ok || !b {
+		t.Errorf("c.CheckURLsWithTimeout()[%q] = %t, want %t", "http://bad.example.com", b, true)
+	}
+}
+
+func TestResultHook(t *testing.T) {
+	var seen []string
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{
+			"210 SCAN DATA",
+			"SCAN /tmp/clean.txt\t[+]0.0",
+			"SCAN /tmp/eicar.com\t[L]0.0\t0 EICAR Test-NOT virus!!!",
+			scanOkResp,
+		}
+	})
+	hook := func(rs *Response) {
+		seen = append(seen, rs.Filename)
+	}
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithResultHook(hook))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	if _, e = c.Scan("/tmp"); e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if strings.Join(seen, ",") != "/tmp/clean.txt,/tmp/eicar.com" {
+		t.Errorf("The result hook saw %q, want both results", seen)
+	}
+}
+
+func TestGreetingValidator(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string { return nil })
+	reject := errors.New("untested daemon")
+	var banner string
+	validator := func(b string) error {
+		banner = b
+		return reject
+	}
+	if _, e := NewClient(context.Background(), address, time.Second, time.Second, WithGreetingValidator(validator)); e != reject {
+		t.Errorf("NewClient() = %v, want %v", e, reject)
+	}
+	if banner != "DAEMON" {
+		t.Errorf("The validator got %q, want %q", banner, "DAEMON")
+	}
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithGreetingValidator(func(string) error { return nil }))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	c.Close()
+}
+
+func TestScanContextDrain(t *testing.T) {
+	handler := func(n int, l string) []string {
+		if strings.HasPrefix(l, Scan.String()) {
+			time.Sleep(150 * time.Millisecond)
+			return []string{"210 SCAN DATA", "SCAN /tmp/clean.txt\t[+]0.0", scanOkResp}
+		}
+		return []string{"210 VPS DATA", "VPS 123456", "200 VPS OK"}
+	}
+	for _, grace := range []time.Duration{0, time.Second} {
+		address := fakeServer(t, handler)
+		c, e := NewClient(context.Background(), address, time.Second, time.Second, WithCancelDrain(grace))
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, e = c.ScanContext(ctx, "/tmp/clean.txt")
+		cancel()
+		if !errors.Is(e, context.DeadlineExceeded) {
+			t.Errorf("c.ScanContext() = %v, want %v", e, context.DeadlineExceeded)
+		}
+		if broken := c.Broken(); broken != (grace == 0) {
+			t.Errorf("c.Broken() = %t with drain grace %s", broken, grace)
+		}
+		if grace > 0 {
+			if v, e := c.Vps(); e != nil || v != 123456 {
+				t.Errorf("c.Vps() = %d, %v after a drained scan", v, e)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestScanAfterCancelWithoutReconnect(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		p := strings.TrimPrefix(l, Scan.String()+" ")
+		if p == "/slow" {
+			time.Sleep(150 * time.Millisecond)
+			return []string{"210 SCAN DATA", "SCAN /slow\t[L]0.0\t0 EICAR Test-NOT virus!!!", scanOkResp}
+		}
+		return []string{"210 SCAN DATA", "SCAN " + p + "\t[+]0.0", scanOkResp}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second, WithAutoReconnect(false))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, e = c.ScanContext(ctx, "/slow"); !errors.Is(e, context.DeadlineExceeded) {
+		t.Fatalf("c.ScanContext() = %v, want %v", e, context.DeadlineExceeded)
+	}
+	time.Sleep(200 * time.Millisecond)
+	r, e := c.Scan("/clean")
+	if !errors.Is(e, ErrBrokenConnection) {
+		t.Errorf("c.Scan() on a broken connection = %v, %v, want %v", r, e, ErrBrokenConnection)
+	}
+	if _, e = c.Vps(); !errors.Is(e, ErrBrokenConnection) {
+		t.Errorf("c.Vps() on a broken connection = %v, want %v", e, ErrBrokenConnection)
+	}
+	rc, ec := c.ScanStream(context.Background(), "/clean")
+	for rs := range rc {
+		t.Errorf("c.ScanStream() on a broken connection returned %v", rs)
+	}
+	if e = <-ec; !errors.Is(e, ErrBrokenConnection) {
+		t.Errorf("c.ScanStream() on a broken connection = %v, want %v", e, ErrBrokenConnection)
+	}
+}
+
+func TestScanTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, m := range []string{"docs/clean.txt", "docs/eicar.com"} {
+		tw.WriteHeader(&tar.Header{Name: m, Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+		tw.Write([]byte("data"))
+	}
+	tw.WriteHeader(&tar.Header{Name: "docs/link", Typeflag: tar.TypeSymlink, Linkname: "clean.txt"})
+	tw.Close()
+
+	scans := 0
+	address := fakeServer(t, func(n int, l string) []string {
+		scans++
+		p := strings.TrimPrefix(l, Scan.String()+" ")
+		return []string{"210 SCAN DATA", "SCAN " + p + "\t[+]0.0", scanOkResp}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.ScanTar(&buf)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 2 || r[0].Filename != "docs/clean.txt" || r[1].Filename != "docs/eicar.com" {
+		t.Errorf("c.ScanTar() = %v, want results for both members", r)
+	}
+	if scans != 2 {
+		t.Errorf("c.ScanTar() sent %d scans, want %d", scans, 2)
+	}
+}
+
+func TestVpsContextCancel(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string { return nil })
+	c, e := NewClient(context.Background(), address, time.Second, 10*time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.tc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if _, e = c.VpsContext(ctx); !errors.Is(e, context.Canceled) {
+		t.Errorf("c.VpsContext() = %v, want %v", e, context.Canceled)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("c.VpsContext() took %s, should return on cancel", d)
+	}
+	if !c.Broken() {
+		t.Errorf("c.Broken() should be true after a cancelled command")
+	}
+}
+
+func TestScanReader(t *testing.T) {
+	var scanned string
+	address := fakeServer(t, func(n int, l string) []string {
+		scanned = strings.TrimPrefix(l, Scan.String()+" ")
+		return []string{"210 SCAN DATA", "SCAN " + scanned + "\t[+]0.0", scanOkResp}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	dir := t.TempDir()
+	c.SetTmpDir(dir)
+	r, e := c.ScanReader(context.Background(), strings.NewReader("data"))
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || r[0].Filename != "" {
+		t.Errorf("c.ScanReader() = %v, want a single result without a filename", r)
+	}
+	if !strings.HasPrefix(scanned, dir+"/") {
+		t.Errorf("c.ScanReader() spooled to %q, want a file in %q", scanned, dir)
+	}
+	if _, e = os.Stat(scanned); !os.IsNotExist(e) {
+		t.Errorf("The temporary file %q should be removed", scanned)
+	}
+}
+
+func TestDetectNetwork(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{AvastSock, "unix"},
+		{"./avast.sock", "unix"},
+		{"avast.sock", "unix"},
+		{"127.0.0.1:5036", "tcp"},
+		{"localhost:5036", "tcp"},
+		{"[::1]:5036", "tcp"},
+		{"localhost:http", "unix"},
+		{"fe80::879:d85f:f836:1b56%en1", "unix"},
+	}
+	for _, tt := range tests {
+		if n := detectNetwork(tt.in); n != tt.out {
+			t.Errorf("detectNetwork(%q) = %q, want %q", tt.in, n, tt.out)
+		}
+	}
+}
+
+func TestScanMixedStatuses(t *testing.T) {
+	address := fakeServer(t, func(n int, l string) []string {
+		return []string{
+			"210 SCAN DATA",
+			"SCAN /tmp/clean.txt\t[+]0.0",
+			"SCAN /tmp/eicar.com\t[L]0.0\t0 EICAR Test-NOT virus!!!",
+			"SCAN /tmp/locked.zip\t[E]0.0\tError 42110 Archive is password protected",
+			scanOkResp,
+		}
+	})
+	c, e := NewClient(context.Background(), address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	r, e := c.Scan("/tmp")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 3 {
+		t.Fatalf("c.Scan() returned %d results, want %d", len(r), 3)
+	}
+	expected := []struct {
+		infected  bool
+		errored   bool
+		signature string
+	}{
+		{false, false, ""},
+		{true, false, "EICAR Test-NOT virus!!!"},
+		{false, true, "Error 42110 Archive is password protected"},
+	}
+	for i, rs := range r {
+		if rs.Infected != expected[i].infected || rs.Errored != expected[i].errored {
+			t.Errorf("%q Infected = %t, Errored = %t, want %t, %t", rs.Filename, rs.Infected, rs.Errored, expected[i].infected, expected[i].errored)
+		}
+		if rs.Signature != expected[i].signature {
+			t.Errorf("%q Signature = %q, want %q", rs.Filename, rs.Signature, expected[i].signature)
+		}
+	}
+}
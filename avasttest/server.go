@@ -0,0 +1,226 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avasttest Golang Avast client
+Avasttest - in memory Avast server for tests
+*/
+package avasttest
+
+import (
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// EICARSignature is the signature reported for EICAR files
+	EICARSignature = "EICAR Test-NOT virus!!!"
+	// VPS is the definitions version reported by DefaultHandler
+	VPS = "VPS 19052406"
+	// Pack is the packer option list reported by DefaultHandler,
+	// the library DefaultPackOptions
+	Pack = "PACK +mime +zip +arj +rar +cab +tar +gz +bzip2 +ace +arc +zoo +lharc +chm +cpio +rpm +7zip +iso +tnef +dbx +sys +ole +exec +winexec +install +dmg"
+	// Flags is the flag list reported by DefaultHandler,
+	// the library DefaultFlags
+	Flags = "FLAGS +fullfiles -allfiles -scandevices"
+	// Sensitivity is the sensitivity list reported by DefaultHandler,
+	// the library DefaultSensitivity
+	Sensitivity = "SENSITIVITY +worm +trojan +adware +spyware +dropper +kit +joke +dangerous +dialer +rootkit +exploit -pup -suspicious -pube"
+	// CloseConn closes the connection when returned as a reply
+	// line by a ConnHandler, the lines before it are sent first
+	CloseConn = "\x00close"
+	greeting  = "220 DAEMON"
+	sockName  = "avast.sock"
+)
+
+// A Handler returns the reply lines for a command line,
+// returning no lines closes the connection
+type Handler func(line string) []string
+
+// A ConnHandler returns the reply lines for a command line read
+// from the n-th accepted connection, counting from zero. Nothing
+// is sent when it returns no lines, CloseConn closes the
+// connection.
+type ConnHandler func(n int, line string) []string
+
+// A Server is an Avast server listening on a unix socket
+// in a temporary directory
+type Server struct {
+	Address string
+	dir     string
+	l       net.Listener
+	h       ConnHandler
+	wg      sync.WaitGroup
+	m       sync.Mutex
+	conns   map[net.Conn]bool
+}
+
+// NewServer starts and returns a Server replying with h,
+// DefaultHandler is used when h is nil
+func NewServer(h Handler) (s *Server, err error) {
+	if h == nil {
+		h = DefaultHandler
+	}
+
+	s, err = NewConnServer(func(n int, line string) []string {
+		r := h(line)
+		if len(r) == 0 {
+			return []string{CloseConn}
+		}
+		return r
+	})
+
+	return
+}
+
+// NewConnServer starts and returns a Server replying with h
+func NewConnServer(h ConnHandler) (s *Server, err error) {
+	var dir string
+	var l net.Listener
+
+	if dir, err = os.MkdirTemp("", "avasttest"); err != nil {
+		return
+	}
+
+	address := filepath.Join(dir, sockName)
+	if l, err = net.Listen("unix", address); err != nil {
+		os.RemoveAll(dir)
+		return
+	}
+
+	s = &Server{
+		Address: address,
+		dir:     dir,
+		l:       l,
+		h:       h,
+		conns:   make(map[net.Conn]bool),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return
+}
+
+// Close stops the server, closes open connections and
+// removes the socket directory
+func (s *Server) Close() (err error) {
+	err = s.l.Close()
+
+	s.m.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.m.Unlock()
+
+	s.wg.Wait()
+	os.RemoveAll(s.dir)
+
+	return
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for n := 0; ; n++ {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.m.Lock()
+		s.conns[conn] = true
+		s.m.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(n, conn)
+	}
+}
+
+func (s *Server) handle(n int, conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.m.Lock()
+		delete(s.conns, conn)
+		s.m.Unlock()
+		conn.Close()
+	}()
+
+	tc := textproto.NewConn(conn)
+	if err := tc.PrintfLine("%s", greeting); err != nil {
+		return
+	}
+
+	for {
+		l, err := tc.ReadLine()
+		if err != nil || l == "QUIT" {
+			return
+		}
+
+		for _, rl := range s.h(n, l) {
+			if rl == CloseConn {
+				return
+			}
+			if err = tc.PrintfLine("%s", rl); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// DefaultHandler replies to the Avast commands with canned
+// responses, scanned paths containing "eicar" are reported
+// as infected with EICARSignature and others as clean
+func DefaultHandler(line string) []string {
+	cmd, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i != -1 {
+		cmd, arg = line[:i], line[i+1:]
+	}
+
+	switch cmd {
+	case "SCAN":
+		return ScanReply(arg, strings.Contains(strings.ToLower(arg), "eicar"))
+	case "VPS":
+		return Reply(cmd, VPS)
+	case "PACK":
+		return Reply(cmd, Pack)
+	case "FLAGS":
+		return Reply(cmd, Flags)
+	case "SENSITIVITY":
+		return Reply(cmd, Sensitivity)
+	case "EXCLUDE":
+		if arg != "" {
+			return []string{"210 EXCLUDE DATA", "200 EXCLUDE OK"}
+		}
+		return Reply(cmd, "EXCLUDE")
+	case "CHECKURL":
+		if strings.Contains(strings.ToLower(arg), "eicar") {
+			return []string{"520 " + arg + "\tURL blocked"}
+		}
+		return []string{"200 CHECKURL OK"}
+	}
+
+	return []string{"500 Unknown command"}
+}
+
+// Reply returns the 210, data and 200 lines for cmd
+func Reply(cmd, data string) []string {
+	return []string{"210 " + cmd + " DATA", data, "200 " + cmd + " OK"}
+}
+
+// ScanReply returns the SCAN reply for path p, infected
+// paths are reported with EICARSignature
+func ScanReply(p string, infected bool) []string {
+	l := "SCAN " + p + "\t[+]0.0"
+	if infected {
+		l = "SCAN " + p + "\t[L]0.0\t0 " + EICARSignature
+	}
+
+	return []string{"210 SCAN DATA", l, "200 SCAN OK"}
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avasttest Golang Avast client
+Avasttest - in memory Avast server for tests
+*/
+package avasttest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/baruwa-enterprise/avast"
+	"github.com/baruwa-enterprise/avast/avasttest"
+)
+
+func TestServer(t *testing.T) {
+	s, e := avasttest.NewServer(nil)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer s.Close()
+	c, e := avast.NewClient(context.Background(), s.Address, time.Second, time.Second)
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	defer c.Close()
+	v, e := c.Vps()
+	if e != nil || v != 19052406 {
+		t.Errorf("c.Vps() = %d, %v, want %d", v, e, 19052406)
+	}
+	r, e := c.Scan("/tmp/eicar.com")
+	if e != nil {
+		t.Fatalf("An error should not be returned: %s", e)
+	}
+	if len(r) != 1 || !r[0].Infected || r[0].Signature != avasttest.EICARSignature {
+		t.Errorf("c.Scan() = %v, want an EICAR infection", r)
+	}
+	if r, e = c.Scan("/tmp/clean.txt"); e != nil || len(r) != 1 || r[0].Infected {
+		t.Errorf("c.Scan() = %v, %v, want a clean result", r, e)
+	}
+	if b, e := c.CheckURL("http://eicar.example.com/"); e != nil || !b {
+		t.Errorf("c.CheckURL() = %t, %v, want blocked", b, e)
+	}
+	if b, e := c.CheckURL("http://www.example.com/"); e != nil || b {
+		t.Errorf("c.CheckURL() = %t, %v, want allowed", b, e)
+	}
+	if e = c.SetExclude("/tmp/excluded"); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+	if _, e = c.GetFlagStates(); e != nil {
+		t.Errorf("An error should not be returned: %s", e)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		build func() (string, error)
+	}{
+		{"Pack", avasttest.Pack, func() (string, error) { return avast.BuildPackCommand(avast.DefaultPackOptions()) }},
+		{"Flags", avasttest.Flags, func() (string, error) { return avast.BuildFlagsCommand(avast.DefaultFlags()) }},
+		{"Sensitivity", avasttest.Sensitivity, func() (string, error) { return avast.BuildSensitivityCommand(avast.DefaultSensitivity()) }},
+	}
+	for _, tt := range tests {
+		l, e := tt.build()
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if tt.reply != l {
+			t.Errorf("avasttest.%s = %q, want the library defaults %q", tt.name, tt.reply, l)
+		}
+	}
+}
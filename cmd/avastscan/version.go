@@ -9,12 +9,16 @@ Avast - Golang Avast cmdline client
 */
 package main
 
+import (
+	"github.com/baruwa-enterprise/avast"
+)
+
 // GitCommit is the git commit that was compiled.
 // This will be filled in by the compiler.
 var GitCommit string
 
 // Version is the main version number that is being run at the moment.
-const Version = "2.0.0"
+const Version = avast.Version
 
 // VersionPrerelease is a pre-release marker for the version.
 // If this is "" (empty string) then it means that it is a final release.
@@ -0,0 +1,369 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	unknownOptionErr = "Unknown option: %s"
+)
+
+// ParsePackOption returns the PackOption named s, the
+// lookup is case insensitive
+func ParsePackOption(s string) (p PackOption, err error) {
+	for p = Mime; p <= Dmg; p++ {
+		if strings.EqualFold(p.String(), s) {
+			return
+		}
+	}
+	p = 0
+	err = fmt.Errorf(unknownOptionErr, s)
+
+	return
+}
+
+// ParseFlag returns the Flag named s, the lookup is
+// case insensitive
+func ParseFlag(s string) (f Flag, err error) {
+	for f = FullFiles; f <= ScanDevices; f++ {
+		if strings.EqualFold(f.String(), s) {
+			return
+		}
+	}
+	f = 0
+	err = fmt.Errorf(unknownOptionErr, s)
+
+	return
+}
+
+// ParseSensiOption returns the SensiOption named s, the
+// lookup is case insensitive
+func ParseSensiOption(s string) (so SensiOption, err error) {
+	for so = Worm; so <= Pube; so++ {
+		if strings.EqualFold(so.String(), s) {
+			return
+		}
+	}
+	so = 0
+	err = fmt.Errorf(unknownOptionErr, s)
+
+	return
+}
+
+// AllPackOptions returns every packer option in order
+func AllPackOptions() (o []PackOption) {
+	for p := Mime; p <= Dmg; p++ {
+		o = append(o, p)
+	}
+
+	return
+}
+
+// AllFlags returns every flag in order
+func AllFlags() (o []Flag) {
+	for f := FullFiles; f <= ScanDevices; f++ {
+		o = append(o, f)
+	}
+
+	return
+}
+
+// AllSensiOptions returns every sensitivity option in order
+func AllSensiOptions() (o []SensiOption) {
+	for so := Worm; so <= Pube; so++ {
+		o = append(o, so)
+	}
+
+	return
+}
+
+// splitOptions splits a comma separated option list
+func splitOptions(s string) (r []string) {
+	for _, n := range strings.Split(s, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			r = append(r, n)
+		}
+	}
+
+	return
+}
+
+// EncodePackOptions returns a comma separated list of packer options
+func EncodePackOptions(o []PackOption) string {
+	n := make([]string, len(o))
+	for i, p := range o {
+		n[i] = p.String()
+	}
+
+	return strings.Join(n, ",")
+}
+
+// DecodePackOptions parses a comma separated list of packer options
+func DecodePackOptions(s string) (o []PackOption, err error) {
+	for _, n := range splitOptions(s) {
+		var p PackOption
+
+		if p, err = ParsePackOption(n); err != nil {
+			o = nil
+			return
+		}
+		o = append(o, p)
+	}
+
+	return
+}
+
+// EncodeFlags returns a comma separated list of flags
+func EncodeFlags(o []Flag) string {
+	n := make([]string, len(o))
+	for i, f := range o {
+		n[i] = f.String()
+	}
+
+	return strings.Join(n, ",")
+}
+
+// DecodeFlags parses a comma separated list of flags
+func DecodeFlags(s string) (o []Flag, err error) {
+	for _, n := range splitOptions(s) {
+		var f Flag
+
+		if f, err = ParseFlag(n); err != nil {
+			o = nil
+			return
+		}
+		o = append(o, f)
+	}
+
+	return
+}
+
+// EncodeSensiOptions returns a comma separated list of sensitivity options
+func EncodeSensiOptions(o []SensiOption) string {
+	n := make([]string, len(o))
+	for i, so := range o {
+		n[i] = so.String()
+	}
+
+	return strings.Join(n, ",")
+}
+
+// DecodeSensiOptions parses a comma separated list of sensitivity options
+func DecodeSensiOptions(s string) (o []SensiOption, err error) {
+	for _, n := range splitOptions(s) {
+		var so SensiOption
+
+		if so, err = ParseSensiOption(n); err != nil {
+			o = nil
+			return
+		}
+		o = append(o, so)
+	}
+
+	return
+}
+
+// Set sets the packer option from its name
+func (p *PackOption) Set(s string) (err error) {
+	var v PackOption
+
+	if v, err = ParsePackOption(strings.TrimSpace(s)); err != nil {
+		return
+	}
+	*p = v
+
+	return
+}
+
+// Type returns the value type name
+func (p *PackOption) Type() string {
+	return "packOption"
+}
+
+// Set sets the flag from its name
+func (f *Flag) Set(s string) (err error) {
+	var v Flag
+
+	if v, err = ParseFlag(strings.TrimSpace(s)); err != nil {
+		return
+	}
+	*f = v
+
+	return
+}
+
+// Type returns the value type name
+func (f *Flag) Type() string {
+	return "flag"
+}
+
+// Set sets the sensitivity option from its name
+func (so *SensiOption) Set(s string) (err error) {
+	var v SensiOption
+
+	if v, err = ParseSensiOption(strings.TrimSpace(s)); err != nil {
+		return
+	}
+	*so = v
+
+	return
+}
+
+// Type returns the value type name
+func (so *SensiOption) Type() string {
+	return "sensiOption"
+}
+
+// MarshalText returns the packer option name
+func (p PackOption) MarshalText() (b []byte, err error) {
+	if p < Mime || p > Dmg {
+		err = fmt.Errorf(invalidOptionErr, p)
+		return
+	}
+	b = []byte(p.String())
+
+	return
+}
+
+// UnmarshalText sets the packer option from its name
+func (p *PackOption) UnmarshalText(b []byte) (err error) {
+	var v PackOption
+
+	if v, err = ParsePackOption(string(b)); err != nil {
+		return
+	}
+	*p = v
+
+	return
+}
+
+// MarshalText returns the flag name
+func (f Flag) MarshalText() (b []byte, err error) {
+	if f < FullFiles || f > ScanDevices {
+		err = fmt.Errorf(invalidOptionErr, f)
+		return
+	}
+	b = []byte(f.String())
+
+	return
+}
+
+// UnmarshalText sets the flag from its name
+func (f *Flag) UnmarshalText(b []byte) (err error) {
+	var v Flag
+
+	if v, err = ParseFlag(string(b)); err != nil {
+		return
+	}
+	*f = v
+
+	return
+}
+
+// MarshalText returns the sensitivity option name
+func (so SensiOption) MarshalText() (b []byte, err error) {
+	if so < Worm || so > Pube {
+		err = fmt.Errorf(invalidOptionErr, so)
+		return
+	}
+	b = []byte(so.String())
+
+	return
+}
+
+// UnmarshalText sets the sensitivity option from its name
+func (so *SensiOption) UnmarshalText(b []byte) (err error) {
+	var v SensiOption
+
+	if v, err = ParseSensiOption(string(b)); err != nil {
+		return
+	}
+	*so = v
+
+	return
+}
+
+// A PackOptionList is a list of packer options that
+// can be set from a comma separated command line value
+type PackOptionList []PackOption
+
+func (l *PackOptionList) String() string {
+	return EncodePackOptions(*l)
+}
+
+// Set appends the comma separated packer options in s
+func (l *PackOptionList) Set(s string) (err error) {
+	var o []PackOption
+
+	if o, err = DecodePackOptions(s); err != nil {
+		return
+	}
+	*l = append(*l, o...)
+
+	return
+}
+
+// Type returns the value type name
+func (l *PackOptionList) Type() string {
+	return "packOptions"
+}
+
+// A FlagList is a list of flags that can be set
+// from a comma separated command line value
+type FlagList []Flag
+
+func (l *FlagList) String() string {
+	return EncodeFlags(*l)
+}
+
+// Set appends the comma separated flags in s
+func (l *FlagList) Set(s string) (err error) {
+	var o []Flag
+
+	if o, err = DecodeFlags(s); err != nil {
+		return
+	}
+	*l = append(*l, o...)
+
+	return
+}
+
+// Type returns the value type name
+func (l *FlagList) Type() string {
+	return "flags"
+}
+
+// A SensiOptionList is a list of sensitivity options that
+// can be set from a comma separated command line value
+type SensiOptionList []SensiOption
+
+func (l *SensiOptionList) String() string {
+	return EncodeSensiOptions(*l)
+}
+
+// Set appends the comma separated sensitivity options in s
+func (l *SensiOptionList) Set(s string) (err error) {
+	var o []SensiOption
+
+	if o, err = DecodeSensiOptions(s); err != nil {
+		return
+	}
+	*l = append(*l, o...)
+
+	return
+}
+
+// Type returns the value type name
+func (l *SensiOptionList) Type() string {
+	return "sensiOptions"
+}
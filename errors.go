@@ -0,0 +1,160 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+var (
+	// ErrPathNotAllowed is returned when a path is outside the allowed roots
+	ErrPathNotAllowed = errors.New("The path is not within the allowed roots")
+	// ErrInvalidPath is returned when a path contains control
+	// characters that would break the line based protocol
+	ErrInvalidPath = errors.New("The path contains control characters")
+	// ErrNoResult is returned when the server returns no result for a file
+	ErrNoResult = errors.New("The server returned no result for the file")
+	// ErrTooManyResults is returned when a scan returns more
+	// result lines than the client maximum
+	ErrTooManyResults = errors.New("The scan returned too many results")
+	// ErrUnsupportedCommand is matched by UnsupportedCommandError
+	ErrUnsupportedCommand = errors.New("The command is not supported by the server")
+	// ErrLicenseExpired is matched by a ResponseError reporting
+	// an expired or invalid license
+	ErrLicenseExpired = errors.New("The server license has expired")
+	// ErrNoSuchPath is matched by a ResponseError reporting
+	// that the scanned path does not exist
+	ErrNoSuchPath = errors.New("No such path")
+	// ErrUntestedDaemon is returned by CompatibilityCheck when
+	// the daemon is outside the tested versions
+	ErrUntestedDaemon = errors.New("The daemon version is not tested")
+	// ErrPermissionDenied is matched by a ResponseError reporting
+	// that the server was denied access
+	ErrPermissionDenied = errors.New("The server was denied permission")
+	// ErrBrokenConnection is returned for commands on a
+	// connection left in an unknown state by a cancelled command
+	// when auto reconnect is disabled
+	ErrBrokenConnection = errors.New("The connection was left in an unknown state")
+)
+
+// A CommandError records the command line sent to the
+// server, the name of the client that sent it, the
+// transcript of the exchange when enabled and the
+// error that it triggered
+type CommandError struct {
+	Client     string
+	Command    string
+	Transcript []string
+	Err        error
+}
+
+func (e *CommandError) Error() string {
+	if e.Client != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Client, e.Command, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Command, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// An UnsupportedCommandError is returned when the server does
+// not implement a command, it matches ErrUnsupportedCommand
+type UnsupportedCommandError struct {
+	Command Command
+}
+
+func (e *UnsupportedCommandError) Error() string {
+	return fmt.Sprintf("The %s command is not supported by the server", e.Command)
+}
+
+// Is reports whether target is ErrUnsupportedCommand
+func (e *UnsupportedCommandError) Is(target error) bool {
+	return target == ErrUnsupportedCommand
+}
+
+// An UntestedDaemonError is returned by CompatibilityCheck
+// when the daemon is outside the tested versions, it matches
+// ErrUntestedDaemon
+type UntestedDaemonError struct {
+	Reason string
+}
+
+func (e *UntestedDaemonError) Error() string {
+	return e.Reason
+}
+
+// Is reports whether target is ErrUntestedDaemon
+func (e *UntestedDaemonError) Is(target error) bool {
+	return target == ErrUntestedDaemon
+}
+
+// A ResponseError is returned when the server response is
+// malformed or carries an error code, Code is zero for
+// responses that could not be parsed. Arg is the argument
+// of the command when the server replied with an error code
+// instead of opening the response.
+type ResponseError struct {
+	Command Command
+	Arg     string
+	Line    string
+	Code    int
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf(invalidRespErr, e.Line)
+	}
+	return fmt.Sprintf("%03d %s", e.Code, e.Line)
+}
+
+// Is reports whether target is ErrLicenseExpired,
+// ErrPermissionDenied or ErrNoSuchPath and the error code
+// message names that condition, the daemon does not use
+// dedicated codes
+func (e *ResponseError) Is(target error) bool {
+	if e.Code == 0 {
+		return false
+	}
+
+	m := strings.ToLower(e.Line)
+	switch target {
+	case ErrLicenseExpired:
+		return strings.Contains(m, "licen")
+	case ErrPermissionDenied:
+		return strings.Contains(m, "permission denied") || strings.Contains(m, "access denied")
+	case ErrNoSuchPath:
+		return (e.Command == Scan && e.Code == noSuchPathCode) || strings.Contains(m, "no such file") ||
+			strings.Contains(m, "not found") || strings.Contains(m, "does not exist")
+	}
+
+	return false
+}
+
+// responseErr converts textproto code errors into
+// ResponseError or UnsupportedCommandError values, arg
+// is the argument of the command
+func responseErr(cmd Command, arg string, err error) error {
+	te, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+
+	if te.Code == unknownCmdCode {
+		return &UnsupportedCommandError{Command: cmd}
+	}
+
+	return &ResponseError{Command: cmd, Arg: arg, Line: te.Msg, Code: te.Code}
+}
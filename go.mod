@@ -1,5 +1,5 @@
 module github.com/baruwa-enterprise/avast
 
-go 1.10
+go 1.20
 
 require github.com/spf13/pflag v1.0.5
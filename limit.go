@@ -0,0 +1,52 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"context"
+)
+
+// A ScanLimiter caps the number of Scan commands in flight
+// across the clients it is passed to with WithScanLimiter
+type ScanLimiter struct {
+	sem chan struct{}
+}
+
+// NewScanLimiter creates and returns a ScanLimiter allowing n
+// concurrent scans, n is raised to 1 when lower
+func NewScanLimiter(n int) (l *ScanLimiter) {
+	if n < 1 {
+		n = 1
+	}
+
+	l = &ScanLimiter{sem: make(chan struct{}, n)}
+
+	return
+}
+
+// Cap returns the number of concurrent scans allowed
+func (l *ScanLimiter) Cap() (n int) {
+	n = cap(l.sem)
+	return
+}
+
+// acquire waits for a scan slot, release must be called when
+// the scan is done
+func (l *ScanLimiter) acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+	release = func() { <-l.sem }
+
+	return
+}
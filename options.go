@@ -0,0 +1,324 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"crypto/tls"
+	"io"
+	"time"
+)
+
+// An Option configures a Client
+type Option func(*Client)
+
+// WithConnTimeout sets the connection timeout, it takes
+// precedence over the NewClient connTimeOut argument
+func WithConnTimeout(t time.Duration) Option {
+	return func(c *Client) {
+		c.SetConnTimeout(t)
+	}
+}
+
+// WithCmdTimeout sets the command timeout, it takes
+// precedence over the NewClient ioTimeOut argument
+func WithCmdTimeout(t time.Duration) Option {
+	return func(c *Client) {
+		c.SetCmdTimeout(t)
+	}
+}
+
+// WithConnRetries sets the number of times the
+// connection is retried
+func WithConnRetries(n int) Option {
+	return func(c *Client) {
+		c.SetConnRetries(n)
+	}
+}
+
+// WithCmdRetries sets the number of times a command that
+// fails with a transient error is retried
+func WithCmdRetries(n int) Option {
+	return func(c *Client) {
+		c.SetCmdRetries(n)
+	}
+}
+
+// WithMaxResults sets the maximum number of result
+// lines read for a scan
+func WithMaxResults(n int) Option {
+	return func(c *Client) {
+		c.SetMaxResults(n)
+	}
+}
+
+// WithConnSleep sets the sleep between connection retries
+func WithConnSleep(t time.Duration) Option {
+	return func(c *Client) {
+		c.SetConnSleep(t)
+	}
+}
+
+// WithAutoReconnect sets whether commands are replayed on a
+// new connection when the connection is closed
+func WithAutoReconnect(v bool) Option {
+	return func(c *Client) {
+		c.SetAutoReconnect(v)
+	}
+}
+
+// WithTmpDir sets the directory used to spool content
+func WithTmpDir(p string) Option {
+	return func(c *Client) {
+		c.SetTmpDir(p)
+	}
+}
+
+// WithLogger sets a function called with every protocol
+// line sent and received
+func WithLogger(l Logger) Option {
+	return func(c *Client) {
+		c.SetLogger(l)
+	}
+}
+
+// WithTracer sets the function used to trace commands
+func WithTracer(f TraceFunc) Option {
+	return func(c *Client) {
+		c.SetTracer(f)
+	}
+}
+
+// WithMetrics sets the metrics receiver
+func WithMetrics(m Metrics) Option {
+	return func(c *Client) {
+		c.SetMetrics(m)
+	}
+}
+
+// WithTLS wraps TCP connections in TLS using cfg, the
+// handshake is bounded by the connection timeout. It can
+// not be used with unix sockets.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = cfg
+	}
+}
+
+// WithDialer sets the function used to connect to the server,
+// it is called within the connection retry loop and bounded by
+// the connection timeout. The unix socket is not required to
+// exist when a dialer is set.
+func WithDialer(f DialFunc) Option {
+	return func(c *Client) {
+		c.dialer = f
+	}
+}
+
+// WithBufferSize sets the size of the read buffer used
+// when wrapping the connection, larger buffers reduce the
+// number of reads required for large scan responses.
+// Writes are flushed per command so only reads are buffered.
+func WithBufferSize(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.bufSize = n
+		}
+	}
+}
+
+// WithAllowedRoots restricts the paths that can be passed to
+// Scan and SetExclude to those under the given roots
+func WithAllowedRoots(roots []string) Option {
+	return func(c *Client) {
+		c.roots = append([]string(nil), roots...)
+	}
+}
+
+// WithMaxConcurrentScans limits the number of Scan commands in
+// flight to n, additional scans wait for a slot. The limit is
+// shared by the client, its clones and the clients of a Pool
+// created with this option, use WithScanLimiter to share one
+// limit between independently created clients.
+func WithMaxConcurrentScans(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.limiter = NewScanLimiter(n)
+		}
+	}
+}
+
+// WithScanLimiter makes the client wait for a slot in l before
+// each Scan command
+func WithScanLimiter(l *ScanLimiter) Option {
+	return func(c *Client) {
+		c.limiter = l
+	}
+}
+
+// WithThreatClassifier sets the function used to group
+// infections into categories when building a ScanReport
+func WithThreatClassifier(f func(signature string) string) Option {
+	return func(c *Client) {
+		c.classifier = f
+	}
+}
+
+// WithName sets a name used to identify the client
+// in errors when connecting to several daemons
+func WithName(name string) Option {
+	return func(c *Client) {
+		c.name = name
+	}
+}
+
+// WithNetwork sets the network used to connect to the
+// daemon, either "unix" or "tcp". Without it the network is
+// detected from the address, host:port addresses use "tcp"
+// and everything else "unix".
+func WithNetwork(network string) Option {
+	return func(c *Client) {
+		c.network = network
+	}
+}
+
+// WithScanRetryOnParseError reconnects and runs a scan again, up
+// to n times, when a line of the response can not be parsed.
+// The whole scan is repeated so this is off by default.
+func WithScanRetryOnParseError(n int) Option {
+	return func(c *Client) {
+		if n > 0 {
+			c.parseRetries = n
+		}
+	}
+}
+
+// WithAbsolutePaths makes relative filenames returned by Scan
+// absolute, the filename sent by the server is kept in
+// Response.RawFilename. Archive items are not changed and
+// only unix socket connections are normalized as the paths
+// of a remote server are not local.
+func WithAbsolutePaths() Option {
+	return func(c *Client) {
+		c.absPaths = true
+	}
+}
+
+// WithCaptureFraming records the opening and closing lines
+// of each command response for retrieval with LastFraming
+func WithCaptureFraming() Option {
+	return func(c *Client) {
+		c.captureFraming = true
+	}
+}
+
+// WithInfectedStatuses sets the statuses that mark a
+// Response as infected, the default is StatusInfected
+func WithInfectedStatuses(s ...ScanStatus) Option {
+	return func(c *Client) {
+		c.infectedStatuses = append([]ScanStatus(nil), s...)
+	}
+}
+
+// WithSyslog writes an RFC 5424 formatted message to w for each
+// infected or unscannable item found by Scan, infections are
+// logged as critical and unscannable items as warnings
+func WithSyslog(w io.Writer) Option {
+	return func(c *Client) {
+		c.syslog = w
+	}
+}
+
+// WithSyslogSDID sends the result fields of the WithSyslog
+// messages as structured data under id, which should be of the
+// form name@<private enterprise number> using the number
+// registered by the caller. Without it the messages carry no
+// structured data.
+func WithSyslogSDID(id string) Option {
+	return func(c *Client) {
+		c.syslogSDID = id
+	}
+}
+
+// WithMaxIdle dials the connection again ahead of a command
+// when it has been idle for longer than d, see SetMaxIdle
+func WithMaxIdle(d time.Duration) Option {
+	return func(c *Client) {
+		c.SetMaxIdle(d)
+	}
+}
+
+// WithScanRoot joins relative scan paths to base, the
+// directory as the server sees it, see SetScanRoot
+func WithScanRoot(base string) Option {
+	return func(c *Client) {
+		c.SetScanRoot(base)
+	}
+}
+
+// WithConnectBackoff retries the initial connection and greeting
+// up to attempts times when the server refuses or drops the
+// connection, times out or its socket does not exist yet. The
+// delay starts at base and doubles up to max with jitter so
+// clients started together do not retry in step, ctx bounds the
+// overall wait. The same backoff replaces the connection retry
+// sleep between dial and command retries.
+func WithConnectBackoff(attempts int, base, max time.Duration) Option {
+	return func(c *Client) {
+		if base <= 0 {
+			base = DefaultSleep
+		}
+		if max < base {
+			max = base
+		}
+		c.connectAttempts = attempts
+		c.backoffBase = base
+		c.backoffMax = max
+	}
+}
+
+// WithTranscript records the lines sent and received for each
+// command, up to max bytes, the transcript is attached to
+// CommandError and available from LastTranscript
+func WithTranscript(max int) Option {
+	return func(c *Client) {
+		if max > 0 {
+			c.transcriptMax = max
+		}
+	}
+}
+
+// WithResultHook calls f for each result as it is parsed during
+// a scan. The hook runs inline so a slow hook slows the scan,
+// it must not modify the Response.
+func WithResultHook(f func(*Response)) Option {
+	return func(c *Client) {
+		c.resultHook = f
+	}
+}
+
+// WithGreetingValidator calls f with the server greeting banner
+// when connecting, the connection is closed and the error
+// returned when f rejects the banner
+func WithGreetingValidator(f func(banner string) error) Option {
+	return func(c *Client) {
+		c.greetingValidator = f
+	}
+}
+
+// WithCancelDrain reads the rest of a cancelled scan response for
+// up to grace so the connection can be reused, connections that
+// can not be drained are marked as broken
+func WithCancelDrain(grace time.Duration) Option {
+	return func(c *Client) {
+		if grace > 0 {
+			c.drainGrace = grace
+		}
+	}
+}
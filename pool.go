@@ -0,0 +1,205 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	poolSizeErr = "Invalid pool size: %d"
+)
+
+// A Pool represents a fixed size set of Avast clients
+// connected to the same server
+type Pool struct {
+	size    int
+	clients chan *Client
+	all     []*Client
+}
+
+// Size returns the number of connections in the pool
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// PoolStats holds the pool connection counts
+type PoolStats struct {
+	InUse int
+	Idle  int
+}
+
+// Stats returns the number of connections in use and idle
+func (p *Pool) Stats() (s PoolStats) {
+	s.Idle = len(p.clients)
+	s.InUse = p.size - s.Idle
+
+	return
+}
+
+// Scan submits a path for scanning on an idle connection,
+// it blocks until a connection is available
+func (p *Pool) Scan(f string) (r []*Response, err error) {
+	r, err = p.ScanContext(context.Background(), f)
+	return
+}
+
+// ScanContext submits a path for scanning on an idle connection,
+// it blocks until a connection is available or ctx is done
+func (p *Pool) ScanContext(ctx context.Context, f string) (r []*Response, err error) {
+	var c *Client
+
+	if c, err = p.get(ctx); err != nil {
+		return
+	}
+	defer p.put(c)
+
+	r, err = c.ScanContext(ctx, f)
+
+	return
+}
+
+// CheckURL checks a URL on an idle connection, it blocks
+// until a connection is available
+func (p *Pool) CheckURL(u string) (b bool, err error) {
+	b, err = p.CheckURLContext(context.Background(), u)
+	return
+}
+
+// CheckURLContext checks a URL on an idle connection, it blocks
+// until a connection is available or ctx is done
+func (p *Pool) CheckURLContext(ctx context.Context, u string) (b bool, err error) {
+	var c *Client
+
+	if c, err = p.get(ctx); err != nil {
+		return
+	}
+	defer p.put(c)
+
+	b, err = c.CheckURLContext(ctx, u)
+
+	return
+}
+
+// ScanFilesOrdered scans paths concurrently using the pool
+// connections, r[i] holds the results for paths[i] and the
+// errors for individual paths are joined in err
+func (p *Pool) ScanFilesOrdered(ctx context.Context, paths []string) (r [][]*Response, err error) {
+	var wg sync.WaitGroup
+
+	r = make([][]*Response, len(paths))
+	errs := make([]error, len(paths))
+	jobs := make(chan int)
+
+	workers := p.size
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				c, e := p.get(ctx)
+				if e != nil {
+					errs[j] = e
+					continue
+				}
+				r[j], errs[j] = c.ScanContext(ctx, paths[j])
+				p.put(c)
+			}
+		}()
+	}
+
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	err = errors.Join(errs...)
+
+	return
+}
+
+// Close closes all the pool connections
+func (p *Pool) Close() (err error) {
+	var errs []error
+
+	for _, c := range p.all {
+		errs = append(errs, c.Close())
+	}
+
+	err = errors.Join(errs...)
+
+	return
+}
+
+// get waits for an idle client or for ctx to be done,
+// broken clients are reconnected before being returned
+func (p *Pool) get(ctx context.Context) (c *Client, err error) {
+	select {
+	case c = <-p.clients:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+
+	if c.Broken() {
+		if err = c.lockedReconnect(ctx); err != nil {
+			p.put(c)
+			c = nil
+		}
+	}
+
+	return
+}
+
+// put returns a client to the pool
+func (p *Pool) put(c *Client) {
+	p.clients <- c
+}
+
+// NewPool creates and returns a Pool of size clients
+// connected to address, opts are applied to each client and
+// the clients share the limit set by WithMaxConcurrentScans
+func NewPool(ctx context.Context, address string, size int, opts ...Option) (p *Pool, err error) {
+	var c *Client
+
+	if size < 1 {
+		err = fmt.Errorf(poolSizeErr, size)
+		return
+	}
+
+	pl := &Pool{
+		size:    size,
+		clients: make(chan *Client, size),
+	}
+
+	for i := 0; i < size; i++ {
+		if c, err = NewClient(ctx, address, 0, 0, opts...); err != nil {
+			pl.Close()
+			return
+		}
+		if i == 0 && c.limiter != nil {
+			opts = append(opts[:len(opts):len(opts)], WithScanLimiter(c.limiter))
+		}
+		pl.all = append(pl.all, c)
+		pl.clients <- c
+	}
+
+	p = pl
+
+	return
+}
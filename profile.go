@@ -0,0 +1,594 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A Profile represents the desired scanner configuration,
+// options missing from the maps are left unchanged and an
+// empty Exclude leaves the exclusion unchanged
+type Profile struct {
+	Pack        map[PackOption]bool
+	Flags       map[Flag]bool
+	Sensitivity map[SensiOption]bool
+	Exclude     string
+}
+
+// optionState is the desired state of a named option
+type optionState struct {
+	name string
+	on   bool
+}
+
+// parseStates parses a +name -name option list
+func parseStates(s string) (m map[string]bool) {
+	m = make(map[string]bool)
+	for _, t := range strings.Fields(s) {
+		switch t[0] {
+		case '+':
+			m[t[1:]] = true
+		case '-':
+			m[t[1:]] = false
+		}
+	}
+
+	return
+}
+
+// stateTokens returns the +name -name tokens required to
+// move the current option list cur to the wanted states
+func stateTokens(cur string, want []optionState) (t []string) {
+	m := parseStates(cur)
+	for _, w := range want {
+		if v, ok := m[w.name]; ok && v == w.on {
+			continue
+		}
+		if w.on {
+			t = append(t, "+"+w.name)
+		} else {
+			t = append(t, "-"+w.name)
+		}
+	}
+
+	return
+}
+
+// GetPackOptions returns the packer options reported by the
+// server mapped to their enabled state, tokens that do not map
+// to a PackOption are ignored so that newer servers still work
+func (c *Client) GetPackOptions() (m map[PackOption]bool, err error) {
+	var s string
+
+	if s, err = c.GetPack(); err != nil {
+		return
+	}
+
+	m = packStateMap(s)
+
+	return
+}
+
+// packStateMap maps the states in a PACK reply, unknown
+// options are ignored
+func packStateMap(s string) (m map[PackOption]bool) {
+	m = make(map[PackOption]bool)
+	for n, v := range parseStates(s) {
+		p, perr := ParsePackOption(n)
+		if perr != nil {
+			continue
+		}
+		m[p] = v
+	}
+
+	return
+}
+
+// GetFlagStates returns the scan flags reported by the server
+// mapped to their enabled state, unknown flags are ignored
+func (c *Client) GetFlagStates() (m map[Flag]bool, err error) {
+	var s string
+
+	if s, err = c.GetFlags(); err != nil {
+		return
+	}
+
+	m = flagStateMap(s)
+
+	return
+}
+
+// flagStateMap maps the states in a FLAGS reply, unknown
+// options are ignored
+func flagStateMap(s string) (m map[Flag]bool) {
+	m = make(map[Flag]bool)
+	for n, v := range parseStates(s) {
+		f, perr := ParseFlag(n)
+		if perr != nil {
+			continue
+		}
+		m[f] = v
+	}
+
+	return
+}
+
+// GetSensitivityStates returns the sensitivity options reported
+// by the server mapped to their enabled state, unknown options
+// are ignored
+func (c *Client) GetSensitivityStates() (m map[SensiOption]bool, err error) {
+	var s string
+
+	if s, err = c.GetSensitivity(); err != nil {
+		return
+	}
+
+	m = sensiStateMap(s)
+
+	return
+}
+
+// sensiStateMap maps the states in a SENSITIVITY reply, unknown
+// options are ignored
+func sensiStateMap(s string) (m map[SensiOption]bool) {
+	m = make(map[SensiOption]bool)
+	for n, v := range parseStates(s) {
+		so, perr := ParseSensiOption(n)
+		if perr != nil {
+			continue
+		}
+		m[so] = v
+	}
+
+	return
+}
+
+// DefaultPackOptions returns the packer options enabled in the
+// daemon out of the box, every packer is enabled. The protocol
+// can not query the defaults, this and DefaultFlags and
+// DefaultSensitivity are the record of them. Each call returns
+// a new map.
+func DefaultPackOptions() (m map[PackOption]bool) {
+	m = make(map[PackOption]bool)
+	for _, o := range AllPackOptions() {
+		m[o] = true
+	}
+
+	return
+}
+
+// DefaultFlags returns the daemon out of the box flags,
+// fullfiles is enabled and allfiles and scandevices are not
+func DefaultFlags() map[Flag]bool {
+	return map[Flag]bool{
+		FullFiles:   true,
+		AllFiles:    false,
+		ScanDevices: false,
+	}
+}
+
+// DefaultSensitivity returns the daemon out of the box
+// sensitivity, every category but pup, suspicious and
+// pube is enabled
+func DefaultSensitivity() (m map[SensiOption]bool) {
+	m = make(map[SensiOption]bool)
+	for _, o := range AllSensiOptions() {
+		m[o] = o != Pup && o != Suspicious && o != Pube
+	}
+
+	return
+}
+
+// ResetServerConfig sets the packer options, flags and
+// sensitivity back to the defaults with one command each
+func (c *Client) ResetServerConfig(ctx context.Context) (err error) {
+	if err = c.SetPackOptionsContext(ctx, DefaultPackOptions()); err != nil {
+		return
+	}
+
+	if err = c.SetFlagStatesContext(ctx, DefaultFlags()); err != nil {
+		return
+	}
+
+	err = c.SetSensitivityStatesContext(ctx, DefaultSensitivity())
+
+	return
+}
+
+// OverridePackOptions applies opts and returns a function that
+// restores the packer options in effect before the call, other
+// commands on the client wait while the options are read and
+// applied. When applying opts fails the previous options are
+// restored and the error is returned joined with any error
+// from restoring them.
+func (c *Client) OverridePackOptions(opts map[PackOption]bool) (restore func() error, err error) {
+	var s string
+	var w, pw []optionState
+	var prev map[PackOption]bool
+
+	if w, err = packStates(opts); err != nil {
+		return
+	}
+
+	ctx := context.Background()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if s, err = c.optionsLocked(ctx, Pack); err != nil {
+		return
+	}
+
+	prev = packStateMap(s)
+	pw, _ = packStates(prev)
+
+	if err = c.setStatesLocked(ctx, Pack, w); err != nil {
+		err = errors.Join(err, c.setStatesLocked(ctx, Pack, pw))
+		return
+	}
+
+	restore = func() error {
+		return c.SetPackOptions(prev)
+	}
+
+	return
+}
+
+// ScanSettings holds flag and sensitivity overrides for a scan,
+// options missing from the maps are left unchanged
+type ScanSettings struct {
+	Flags       map[Flag]bool
+	Sensitivity map[SensiOption]bool
+}
+
+// ScanWithSettings applies s, scans p and then restores the
+// flags and sensitivity in effect before the call. The protocol
+// does not say whether the settings are scoped to the connection
+// so other connections may see them while the scan runs.
+func (c *Client) ScanWithSettings(ctx context.Context, p string, s ScanSettings) (r []*Response, err error) {
+	var o string
+	var release func()
+	var wf, ws []optionState
+	var flags map[Flag]bool
+	var sensi map[SensiOption]bool
+
+	p = c.scanPath(p)
+	if err = c.checkPath(p); err != nil {
+		return
+	}
+
+	if wf, err = flagStates(s.Flags); err != nil {
+		return
+	}
+
+	if ws, err = sensiStates(s.Sensitivity); err != nil {
+		return
+	}
+
+	if release, err = c.acquireScan(ctx); err != nil {
+		return
+	}
+	defer release()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if len(wf) > 0 {
+		if o, err = c.optionsLocked(ctx, Flags); err != nil {
+			return
+		}
+		flags = flagStateMap(o)
+	}
+
+	if len(ws) > 0 {
+		if o, err = c.optionsLocked(ctx, Sensitivity); err != nil {
+			return
+		}
+		sensi = sensiStateMap(o)
+	}
+
+	defer func() {
+		var ferr, serr error
+		if w, werr := flagStates(flags); werr == nil {
+			ferr = c.setStatesLocked(context.Background(), Flags, w)
+		}
+		if w, werr := sensiStates(sensi); werr == nil {
+			serr = c.setStatesLocked(context.Background(), Sensitivity, w)
+		}
+		err = errors.Join(err, ferr, serr)
+	}()
+
+	if err = c.setStatesLocked(ctx, Flags, wf); err != nil {
+		return
+	}
+
+	if err = c.setStatesLocked(ctx, Sensitivity, ws); err != nil {
+		return
+	}
+
+	r, err = c.scanLocked(ctx, p)
+
+	return
+}
+
+// setStatesContext sends the wanted option states as a single
+// command, nothing is sent when w is empty
+func (c *Client) setStatesContext(ctx context.Context, cmd Command, w []optionState) (err error) {
+	if len(w) == 0 {
+		return
+	}
+
+	_, err = c.basicCmdContext(ctx, cmd, stateArgs(w))
+
+	return
+}
+
+// setStatesLocked is setStatesContext for callers holding c.m
+func (c *Client) setStatesLocked(ctx context.Context, cmd Command, w []optionState) (err error) {
+	if len(w) == 0 {
+		return
+	}
+
+	_, err = c.basicCmdLocked(ctx, cmd, stateArgs(w))
+
+	return
+}
+
+// stateArgs returns the +name -name arguments for w
+func stateArgs(w []optionState) string {
+	t := make([]string, len(w))
+	for i, o := range w {
+		if o.on {
+			t[i] = "+" + o.name
+		} else {
+			t[i] = "-" + o.name
+		}
+	}
+
+	return strings.Join(t, " ")
+}
+
+// packStates checks opts and returns their states in
+// declaration order
+func packStates(opts map[PackOption]bool) (w []optionState, err error) {
+	for o := range opts {
+		if o < Mime || o > Dmg {
+			err = fmt.Errorf(invalidOptionErr, o)
+			return
+		}
+	}
+
+	for o := Mime; o <= Dmg; o++ {
+		if v, ok := opts[o]; ok {
+			w = append(w, optionState{o.String(), v})
+		}
+	}
+
+	return
+}
+
+// flagStates checks opts and returns their states in
+// declaration order
+func flagStates(opts map[Flag]bool) (w []optionState, err error) {
+	for o := range opts {
+		if o < FullFiles || o > ScanDevices {
+			err = fmt.Errorf(invalidOptionErr, o)
+			return
+		}
+	}
+
+	for o := FullFiles; o <= ScanDevices; o++ {
+		if v, ok := opts[o]; ok {
+			w = append(w, optionState{o.String(), v})
+		}
+	}
+
+	return
+}
+
+// sensiStates checks opts and returns their states in
+// declaration order
+func sensiStates(opts map[SensiOption]bool) (w []optionState, err error) {
+	for o := range opts {
+		if o < Worm || o > Pube {
+			err = fmt.Errorf(invalidOptionErr, o)
+			return
+		}
+	}
+
+	for o := Worm; o <= Pube; o++ {
+		if v, ok := opts[o]; ok {
+			w = append(w, optionState{o.String(), v})
+		}
+	}
+
+	return
+}
+
+// buildStatesCommand returns the command line for w, it is
+// empty when w is empty as nothing is sent
+func buildStatesCommand(cmd Command, w []optionState) (l string) {
+	if len(w) > 0 {
+		l = fmt.Sprintf("%s %s", cmd, stateArgs(w))
+	}
+
+	return
+}
+
+// BuildPackCommand returns the command line SetPackOptions
+// sends for opts without sending it, the line is empty when
+// opts is empty as nothing is sent
+func BuildPackCommand(opts map[PackOption]bool) (l string, err error) {
+	var w []optionState
+
+	if w, err = packStates(opts); err != nil {
+		return
+	}
+	l = buildStatesCommand(Pack, w)
+
+	return
+}
+
+// BuildFlagsCommand returns the command line SetFlagStates
+// sends for opts without sending it, the line is empty when
+// opts is empty as nothing is sent
+func BuildFlagsCommand(opts map[Flag]bool) (l string, err error) {
+	var w []optionState
+
+	if w, err = flagStates(opts); err != nil {
+		return
+	}
+	l = buildStatesCommand(Flags, w)
+
+	return
+}
+
+// BuildSensitivityCommand returns the command line
+// SetSensitivityStates sends for opts without sending it, the
+// line is empty when opts is empty as nothing is sent
+func BuildSensitivityCommand(opts map[SensiOption]bool) (l string, err error) {
+	var w []optionState
+
+	if w, err = sensiStates(opts); err != nil {
+		return
+	}
+	l = buildStatesCommand(Sensitivity, w)
+
+	return
+}
+
+// PackOptionState describes the state of a packer option,
+// Default is true when the state matches the known default
+type PackOptionState struct {
+	Option  PackOption
+	Enabled bool
+	Default bool
+}
+
+// GetPackOptionsWithDefaults returns the packer options annotated
+// with whether they match the given defaults, the daemon does not
+// distinguish defaults from overrides. Options missing from defaults
+// are reported as default and unknown options are ignored.
+func (c *Client) GetPackOptionsWithDefaults(defaults map[PackOption]bool) (r []PackOptionState, err error) {
+	var s string
+
+	if s, err = c.GetPack(); err != nil {
+		return
+	}
+
+	for _, t := range strings.Fields(s) {
+		if t[0] != '+' && t[0] != '-' {
+			continue
+		}
+		p, perr := ParsePackOption(t[1:])
+		if perr != nil {
+			continue
+		}
+		st := PackOptionState{
+			Option:  p,
+			Enabled: t[0] == '+',
+			Default: true,
+		}
+		if d, ok := defaults[p]; ok {
+			st.Default = d == st.Enabled
+		}
+		r = append(r, st)
+	}
+
+	return
+}
+
+// SupportedArchives returns the packer options listed by the
+// server, tokens that do not map to a PackOption are returned
+// in unknown
+func (c *Client) SupportedArchives() (r []PackOption, unknown []string, err error) {
+	var s string
+
+	if s, err = c.GetPack(); err != nil {
+		return
+	}
+
+	for _, t := range strings.Fields(s) {
+		n := strings.TrimLeft(t, "+-")
+		if p, perr := ParsePackOption(n); perr == nil {
+			r = append(r, p)
+		} else {
+			unknown = append(unknown, n)
+		}
+	}
+
+	return
+}
+
+// ApplyProfile moves the scanner configuration to the state
+// described by p sending only the commands that are required,
+// other commands on the client wait until it returns. The
+// profile is checked before any command is sent so an invalid
+// option or exclude path leaves the configuration unchanged.
+func (c *Client) ApplyProfile(p Profile) (err error) {
+	var s string
+	var t []string
+	var wp, wf, ws []optionState
+
+	if wp, err = packStates(p.Pack); err != nil {
+		return
+	}
+
+	if wf, err = flagStates(p.Flags); err != nil {
+		return
+	}
+
+	if ws, err = sensiStates(p.Sensitivity); err != nil {
+		return
+	}
+
+	if p.Exclude != "" {
+		if err = c.checkExclude(p.Exclude); err != nil {
+			return
+		}
+	}
+
+	ctx := context.Background()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, cs := range []struct {
+		cmd Command
+		w   []optionState
+	}{{Pack, wp}, {Flags, wf}, {Sensitivity, ws}} {
+		if len(cs.w) == 0 {
+			continue
+		}
+		if s, err = c.optionsLocked(ctx, cs.cmd); err != nil {
+			return
+		}
+		if t = stateTokens(s, cs.w); len(t) > 0 {
+			if _, err = c.basicCmdLocked(ctx, cs.cmd, strings.Join(t, " ")); err != nil {
+				return
+			}
+		}
+	}
+
+	if p.Exclude != "" {
+		if s, err = c.excludeLocked(ctx); err != nil {
+			return
+		}
+		if s != p.Exclude {
+			_, err = c.basicCmdLocked(ctx, Exclude, p.Exclude)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// QuarantineManifest is the name of the manifest file written
+	// to the quarantine directory, it holds one JSON entry per line
+	QuarantineManifest = "manifest.jsonl"
+)
+
+// A QuarantineEntry records a file moved to quarantine
+type QuarantineEntry struct {
+	Original    string    `json:"original"`
+	Quarantined string    `json:"quarantined"`
+	Signature   string    `json:"signature"`
+	Time        time.Time `json:"time"`
+}
+
+// A QuarantineReport holds the results of a quarantine scan
+type QuarantineReport struct {
+	Results     []*Response
+	Quarantined []QuarantineEntry
+	Failed      map[string]error
+}
+
+// QuarantineScan scans p and moves each infected file into
+// quarantineDir, recording it in the directory manifest.
+// Infected archive members are not moved as they are not
+// standalone files. Files that can not be moved are listed
+// in the report Failed map.
+func (c *Client) QuarantineScan(p, quarantineDir string) (rp *QuarantineReport, err error) {
+	var r []*Response
+	var mf *os.File
+
+	if r, err = c.Scan(p); err != nil {
+		return
+	}
+
+	rp = &QuarantineReport{
+		Results: r,
+		Failed:  make(map[string]error),
+	}
+
+	if err = os.MkdirAll(quarantineDir, 0700); err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, rs := range r {
+		if !rs.Infected || rs.ArchiveItem != "" || seen[rs.Filename] {
+			continue
+		}
+		seen[rs.Filename] = true
+
+		dst := filepath.Join(quarantineDir, fmt.Sprintf("%s.%d", filepath.Base(rs.Filename), time.Now().UnixNano()))
+		if e := moveFile(rs.Filename, dst); e != nil {
+			rp.Failed[rs.Filename] = e
+			continue
+		}
+
+		rp.Quarantined = append(rp.Quarantined, QuarantineEntry{
+			Original:    rs.Filename,
+			Quarantined: dst,
+			Signature:   rs.Signature,
+			Time:        time.Now(),
+		})
+	}
+
+	if len(rp.Quarantined) == 0 {
+		return
+	}
+
+	if mf, err = os.OpenFile(filepath.Join(quarantineDir, QuarantineManifest), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		return
+	}
+	defer mf.Close()
+
+	enc := json.NewEncoder(mf)
+	for _, qe := range rp.Quarantined {
+		if err = enc.Encode(qe); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// moveFile renames src to dst, copying and removing src
+// when they are on different filesystems
+func moveFile(src, dst string) (err error) {
+	var in, out *os.File
+
+	if err = os.Rename(src, dst); err == nil || !errors.Is(err, syscall.EXDEV) {
+		return
+	}
+
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+
+	if out, err = os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+		return
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return
+	}
+
+	if err = out.Close(); err != nil {
+		os.Remove(dst)
+		return
+	}
+
+	if err = os.Remove(src); err != nil {
+		os.Remove(dst)
+	}
+
+	return
+}
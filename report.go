@@ -0,0 +1,169 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	unknownCategory = "unknown"
+)
+
+// A ThreatClassifier maps a signature to a threat category
+type ThreatClassifier func(signature string) string
+
+// ScanReport summarises the results of a scan, top level
+// files and archive members are counted separately
+type ScanReport struct {
+	Results         []*Response
+	CategoryCounts  map[string]int
+	Files           int
+	InfectedFiles   int
+	ArchiveMembers  int
+	InfectedMembers int
+}
+
+// InfectionRatio returns the ratio of infected items to all
+// scanned items, files and archive members combined
+func (rp *ScanReport) InfectionRatio() float64 {
+	total := rp.Files + rp.ArchiveMembers
+	if total == 0 {
+		return 0
+	}
+
+	return float64(rp.InfectedFiles+rp.InfectedMembers) / float64(total)
+}
+
+// IsInfected reports whether the result is an infection
+func (r *Response) IsInfected() bool {
+	return r != nil && r.Infected
+}
+
+// AnyInfected reports whether any of the results is an infection
+func AnyInfected(r []*Response) bool {
+	for _, rs := range r {
+		if rs.IsInfected() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Infections returns the infected results
+func Infections(r []*Response) (i []*Response) {
+	for _, rs := range r {
+		if rs.IsInfected() {
+			i = append(i, rs)
+		}
+	}
+
+	return
+}
+
+// ScanSummary counts scan results by outcome, Signatures
+// holds the distinct signatures found in sorted order
+type ScanSummary struct {
+	Clean      int
+	Infected   int
+	Errored    int
+	Signatures []string
+}
+
+// AnyInfected reports whether any infection was found
+func (s ScanSummary) AnyInfected() bool {
+	return s.Infected > 0
+}
+
+// Summarize counts the clean, infected and errored results
+// and collects the distinct signatures
+func Summarize(r []*Response) (s ScanSummary) {
+	seen := make(map[string]bool)
+	for _, rs := range r {
+		switch {
+		case rs.Infected:
+			s.Infected++
+		case rs.Errored:
+			s.Errored++
+		default:
+			s.Clean++
+		}
+		if rs.Infected && rs.Signature != "" && !seen[rs.Signature] {
+			seen[rs.Signature] = true
+			s.Signatures = append(s.Signatures, rs.Signature)
+		}
+	}
+	sort.Strings(s.Signatures)
+
+	return
+}
+
+// DefaultThreatClassifier groups signatures by their prefix,
+// the text before the first space or hyphen
+func DefaultThreatClassifier(signature string) (s string) {
+	s = strings.TrimSpace(signature)
+	if i := strings.IndexAny(s, " \t-"); i != -1 {
+		s = s[:i]
+	}
+
+	if s == "" {
+		s = unknownCategory
+	}
+
+	return
+}
+
+// NewScanReport builds a report from scan results, infected
+// results are counted per category using classify, the
+// DefaultThreatClassifier is used when classify is nil
+func NewScanReport(r []*Response, classify ThreatClassifier) (rp *ScanReport) {
+	if classify == nil {
+		classify = DefaultThreatClassifier
+	}
+
+	rp = &ScanReport{
+		Results:        r,
+		CategoryCounts: make(map[string]int),
+	}
+
+	for _, rs := range r {
+		if rs.ArchiveItem == "" {
+			rp.Files++
+		} else {
+			rp.ArchiveMembers++
+		}
+		if !rs.Infected {
+			continue
+		}
+		if rs.ArchiveItem == "" {
+			rp.InfectedFiles++
+		} else {
+			rp.InfectedMembers++
+		}
+		rp.CategoryCounts[classify(rs.Signature)]++
+	}
+
+	return
+}
+
+// Report scans p and returns a report of the results
+func (c *Client) Report(p string) (rp *ScanReport, err error) {
+	var r []*Response
+
+	if r, err = c.Scan(p); err != nil {
+		return
+	}
+
+	rp = NewScanReport(r, c.classifier)
+
+	return
+}
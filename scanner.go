@@ -0,0 +1,34 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"context"
+)
+
+// A Scanner is the set of commands implemented by Client,
+// code that depends on a Scanner can be tested with a fake
+type Scanner interface {
+	Scan(p string) ([]*Response, error)
+	ScanContext(ctx context.Context, p string) ([]*Response, error)
+	Vps() (int, error)
+	GetPack() (string, error)
+	SetPack(o PackOption, v bool) error
+	GetFlags() (string, error)
+	SetFlags(o Flag, v bool) error
+	GetSensitivity() (string, error)
+	SetSensitivity(o SensiOption, v bool) error
+	GetExclude() (string, error)
+	SetExclude(p string) error
+	CheckURL(u string) (bool, error)
+	Close() error
+}
+
+var _ Scanner = (*Client)(nil)
@@ -0,0 +1,134 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	spoolPattern = "avast-spool-*"
+)
+
+// ScanNamed writes the content of r to a temporary file, scans
+// it and labels the results with name instead of the temporary
+// path. The server needs read access to the temporary directory.
+func (c *Client) ScanNamed(name string, r io.Reader) (rs []*Response, err error) {
+	rs, err = c.scanNamed(context.Background(), name, r)
+	return
+}
+
+// ScanReader writes the content of r to a temporary file in the
+// directory set with SetTmpDir and scans it, the temporary path
+// is replaced with an empty name in the results
+func (c *Client) ScanReader(ctx context.Context, r io.Reader) (rs []*Response, err error) {
+	rs, err = c.scanNamed(ctx, "", r)
+	return
+}
+
+// SetTmpDir sets the directory used to spool content for
+// scanning, the server needs read access to it. The system
+// temporary directory is used by default.
+func (c *Client) SetTmpDir(p string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.tmpDir = p
+}
+
+func (c *Client) scanNamed(ctx context.Context, name string, r io.Reader) (rs []*Response, err error) {
+	var fn string
+
+	if fn, err = c.spool(r); err != nil {
+		return
+	}
+	defer os.Remove(fn)
+
+	if rs, err = c.scan(ctx, fn); err != nil {
+		return
+	}
+
+	for _, rt := range rs {
+		if rt.Filename != fn && rt.RawFilename != fn {
+			continue
+		}
+		rt.Raw = strings.Replace(rt.Raw, rt.RawFilename, name, 1)
+		rt.Filename = name
+		rt.RawFilename = name
+		rt.Path = name
+		if len(rt.ArchivePath) > 0 {
+			rt.ArchivePath[0] = name
+		}
+	}
+
+	return
+}
+
+// ScanTar reads a tar stream and scans each regular file member
+// on its own, results are labeled with the member path.
+// Directories and special files are skipped.
+func (c *Client) ScanTar(r io.Reader) (rs []*Response, err error) {
+	var h *tar.Header
+	var mr []*Response
+
+	tr := tar.NewReader(r)
+	for {
+		if h, err = tr.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if mr, err = c.ScanNamed(h.Name, tr); err != nil {
+			return
+		}
+
+		rs = append(rs, mr...)
+	}
+}
+
+// spool writes r to a temporary file that the server can read
+func (c *Client) spool(r io.Reader) (fn string, err error) {
+	var f *os.File
+
+	c.m.Lock()
+	dir := c.tmpDir
+	c.m.Unlock()
+
+	if f, err = os.CreateTemp(dir, spoolPattern); err != nil {
+		return
+	}
+
+	fn = f.Name()
+
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Chmod(0644)
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		os.Remove(fn)
+		fn = ""
+	}
+
+	return
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"fmt"
+)
+
+const (
+	unknownStatusErr = "Unknown scan status: %q"
+)
+
+const (
+	// StatusClean represents a clean item
+	StatusClean ScanStatus = iota + 1
+	// StatusInfected represents an infected item
+	StatusInfected
+	// StatusError represents an item that could not be scanned
+	StatusError
+)
+
+// A ScanStatus represents the status of a scanned item
+type ScanStatus int
+
+func (s ScanStatus) String() (r string) {
+	n := [...]string{
+		"",
+		"clean",
+		"infected",
+		"error",
+	}
+	if s < StatusClean || s > StatusError {
+		r = ""
+		return
+	}
+	r = n[s]
+	return
+}
+
+// ParseScanStatus returns the ScanStatus of the status
+// character sent by the server, "+", "L" or "E"
+func ParseScanStatus(s string) (st ScanStatus, err error) {
+	if st = scanStatus(s); st == 0 {
+		err = fmt.Errorf(unknownStatusErr, s)
+	}
+
+	return
+}
+
+// scanStatus returns the ScanStatus of a wire status
+func scanStatus(s string) (st ScanStatus) {
+	switch s {
+	case "+":
+		st = StatusClean
+	case "L":
+		st = StatusInfected
+	case "E":
+		st = StatusError
+	}
+
+	return
+}
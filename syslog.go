@@ -0,0 +1,102 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	syslogFacility = 1 // user-level messages
+	syslogCrit     = 2
+	syslogWarning  = 4
+	syslogAppName  = "avast"
+)
+
+var (
+	sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+)
+
+// syslogSeverity maps a result to a syslog severity, ok
+// is false for results that should not be logged
+func syslogSeverity(rs *Response) (sev int, ok bool) {
+	switch scanStatus(rs.Status) {
+	case StatusInfected:
+		sev, ok = syslogCrit, true
+	case StatusError:
+		sev, ok = syslogWarning, true
+	default:
+		if rs.Infected {
+			sev, ok = syslogCrit, true
+		}
+	}
+
+	return
+}
+
+// formatSyslog formats a result as an RFC 5424 message, the
+// result fields are sent as structured data under sdID and
+// the structured data is left empty when sdID is empty
+func formatSyslog(rs *Response, t time.Time, host, sdID string) (m string, ok bool) {
+	var sev int
+
+	if sev, ok = syslogSeverity(rs); !ok {
+		return
+	}
+
+	st := scanStatus(rs.Status).String()
+	if rs.Infected {
+		st = StatusInfected.String()
+	}
+
+	sd := "-"
+	if sdID != "" {
+		sd = fmt.Sprintf(`[%s file="%s" item="%s" status="%s" signature="%s"]`,
+			sdID,
+			sdEscaper.Replace(rs.Filename),
+			sdEscaper.Replace(rs.ArchiveItem),
+			st,
+			sdEscaper.Replace(rs.Signature),
+		)
+	}
+
+	m = fmt.Sprintf(`<%d>1 %s %s %s %d - %s %s: %s %s`,
+		syslogFacility*8+sev,
+		t.UTC().Format(time.RFC3339Nano),
+		host,
+		syslogAppName,
+		os.Getpid(),
+		sd,
+		st,
+		rs.Filename,
+		rs.Signature,
+	)
+
+	return
+}
+
+// logResults writes a syslog message for each infected or
+// unscannable result to the configured syslog writer
+func (c *Client) logResults(r []*Response) {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "-"
+	}
+
+	now := time.Now()
+	for _, rs := range r {
+		if m, ok := formatSyslog(rs, now, host, c.syslogSDID); ok {
+			c.syslog.Write([]byte(m + "\n"))
+		}
+	}
+}
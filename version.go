@@ -0,0 +1,70 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of the client library
+const Version = "2.0.0"
+
+const (
+	testedDaemon     = "DAEMON"
+	testedMajor      = 4
+	minTestedVPS     = 18010100
+	untestedGreetErr = "The greeting %q is not from a tested daemon"
+	untestedMajorErr = "The daemon version %s is not tested, tested versions are %d.x"
+	untestedVPSErr   = "The definitions version %d is older than the tested %d"
+)
+
+// CompatibilityCheck reports whether the daemon is within the
+// tested range, see CompatibilityCheckContext
+func (c *Client) CompatibilityCheck() (err error) {
+	err = c.CompatibilityCheckContext(context.Background())
+	return
+}
+
+// CompatibilityCheckContext compares the server greeting and the
+// virus definitions version against the daemon versions this
+// library is tested with, an untested daemon returns an
+// UntestedDaemonError that describes the mismatch. The
+// greeting is expected to be "DAEMON" optionally followed by the
+// daemon version.
+func (c *Client) CompatibilityCheckContext(ctx context.Context) (err error) {
+	var v VPSInfo
+
+	f := strings.Fields(c.Greeting())
+	if len(f) == 0 || f[0] != testedDaemon {
+		err = &UntestedDaemonError{Reason: fmt.Sprintf(untestedGreetErr, c.Greeting())}
+		return
+	}
+
+	if len(f) > 1 {
+		major, perr := strconv.Atoi(strings.SplitN(f[1], ".", 2)[0])
+		if perr != nil || major != testedMajor {
+			err = &UntestedDaemonError{Reason: fmt.Sprintf(untestedMajorErr, f[1], testedMajor)}
+			return
+		}
+	}
+
+	if v, err = c.VpsInfoContext(ctx); err != nil {
+		return
+	}
+
+	if v.Version < minTestedVPS {
+		err = &UntestedDaemonError{Reason: fmt.Sprintf(untestedVPSErr, v.Version, minTestedVPS)}
+	}
+
+	return
+}
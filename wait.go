@@ -0,0 +1,56 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	waitMinDelay = 100 * time.Millisecond
+	waitMaxDelay = 5 * time.Second
+)
+
+// WaitForSocket waits for the unix socket at address to exist
+// and accept connections, retrying with backoff until ctx expires
+func WaitForSocket(ctx context.Context, address string) (err error) {
+	var conn net.Conn
+	var d net.Dialer
+
+	if address == "" {
+		address = AvastSock
+	}
+
+	delay := waitMinDelay
+	for {
+		if _, err = os.Stat(address); err == nil {
+			if conn, err = d.DialContext(ctx, "unix", address); err == nil {
+				conn.Close()
+				return
+			}
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			err = ctx.Err()
+			return
+		case <-t.C:
+		}
+
+		if delay *= 2; delay > waitMaxDelay {
+			delay = waitMaxDelay
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (C) 2018-2021 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+/*
+Package avast Golang Avast client
+Avast - Golang Avast client
+*/
+package avast
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	sentPrefix      = "> "
+	receivedPrefix  = "< "
+	truncatedMarker = "... transcript truncated"
+	// LogSent is the direction passed to a Logger for sent lines
+	LogSent = "send"
+	// LogReceived is the direction passed to a Logger for
+	// received lines
+	LogReceived = "receive"
+)
+
+// A Logger is called with the textproto command id, the
+// direction and the line for every protocol line exchanged
+type Logger func(id uint, direction, line string)
+
+// beginCmd resets the per command state
+func (c *Client) beginCmd() {
+	c.lastCode, c.lastStatus = 0, ""
+	c.lastDuration = 0
+	c.cmdStart = time.Now()
+
+	if c.captureFraming {
+		c.framing = Framing{}
+	}
+
+	if c.transcriptMax > 0 {
+		c.transcript = nil
+		c.transcriptSize = 0
+	}
+}
+
+// record appends a line to the transcript of the current
+// command, lines past the size limit are dropped
+func (c *Client) record(prefix, l string) {
+	if c.transcriptMax <= 0 || c.transcriptSize > c.transcriptMax {
+		return
+	}
+
+	c.transcriptSize += len(l)
+	if c.transcriptSize > c.transcriptMax {
+		c.transcript = append(c.transcript, truncatedMarker)
+		return
+	}
+
+	c.transcript = append(c.transcript, prefix+l)
+}
+
+// send writes a command line to the server
+func (c *Client) send(l string) (id uint, err error) {
+	c.record(sentPrefix, l)
+	id, err = c.tc.Cmd("%s", l)
+	c.cmdID = id
+	if c.logger != nil {
+		c.logger(id, LogSent, l)
+	}
+
+	return
+}
+
+// readLine reads a response line from the server
+func (c *Client) readLine() (l string, err error) {
+	if l, err = c.tc.ReadLine(); err == nil {
+		c.lastUsed = time.Now()
+		c.record(receivedPrefix, l)
+		if c.logger != nil {
+			c.logger(c.cmdID, LogReceived, l)
+		}
+	}
+
+	return
+}
+
+// readCodeLine reads a response line with the expected code
+func (c *Client) readCodeLine(expect int) (code int, msg string, err error) {
+	code, msg, err = c.tc.ReadCodeLine(expect)
+	if err == nil {
+		c.lastUsed = time.Now()
+	}
+	if code != 0 && (c.transcriptMax > 0 || c.logger != nil) {
+		l := fmt.Sprintf("%d %s", code, msg)
+		c.record(receivedPrefix, l)
+		if c.logger != nil {
+			c.logger(c.cmdID, LogReceived, l)
+		}
+	}
+
+	return
+}
+
+// lastTranscript returns a copy of the current transcript
+func (c *Client) lastTranscript() (t []string) {
+	if len(c.transcript) > 0 {
+		t = append(t, c.transcript...)
+	}
+
+	return
+}